@@ -0,0 +1,649 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// archiveEntry is one file, directory or preserved symlink below src queued
+// for an archive.
+type archiveEntry struct {
+	path string // path on disk
+	rel  string // slash-separated path relative to src
+	name string // slash-separated name in the archive, including prefix
+	info fs.FileInfo
+	link string // symlink target when the link itself is archived
+}
+
+// archiveScan is the filtered list of entries for an archive and the
+// counts reported in done.extra.
+type archiveScan struct {
+	entries     []archiveEntry
+	included    int // files
+	skipped     int // files left out individually
+	skippedDirs int // directories pruned with everything below them
+}
+
+// archiveError carries the done.reason for a failed archive walk.
+type archiveError struct {
+	reason string
+	err    error
+}
+
+func (e *archiveError) Error() string { return e.err.Error() }
+
+// Symlink policies for zip-dir and tar-dir.
+const (
+	symlinksFollow   = "follow"
+	symlinksPreserve = "preserve"
+	symlinksReject   = "reject"
+)
+
+// archiveWalker collects the entries below root. Unlike filepath.WalkDir it
+// applies the symlink policy, tracking the resolved directories on the
+// current path so followed links cannot loop.
+type archiveWalker struct {
+	req      runRequest
+	filter   *archiveFilter
+	symlinks string
+	root     string // src with symlinks resolved
+	omit     map[string]bool
+	scan     *archiveScan
+}
+
+// collectEntries walks req.Src and returns the entries (excluding src
+// itself) that pass the include/exclude/.opdignore filter, in walk order or
+// sorted by archive name in reproducible mode. With include patterns set,
+// only directories leading to an included file are kept. The omit paths (the
+// archive being written) are always skipped.
+func collectEntries(req runRequest, filter *archiveFilter, omit ...string) (*archiveScan, error) {
+	root, err := filepath.Abs(req.Src)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w := &archiveWalker{req: req, filter: filter, symlinks: req.Symlinks, root: root, omit: map[string]bool{}, scan: &archiveScan{}}
+	if w.symlinks == "" {
+		w.symlinks = symlinksFollow
+	}
+	for _, p := range omit {
+		w.omit[resolvedPath(p)] = true
+	}
+	if err := w.walk(root, "", []string{root}, false); err != nil {
+		return nil, err
+	}
+	scan := w.scan
+	if len(filter.include) > 0 {
+		needed := map[string]bool{}
+		for _, e := range scan.entries {
+			if !e.info.IsDir() {
+				for dir := pathDir(e.name); dir != ""; dir = pathDir(dir) {
+					needed[dir] = true
+				}
+			}
+		}
+		kept := scan.entries[:0]
+		for _, e := range scan.entries {
+			if !e.info.IsDir() || needed[e.name] {
+				kept = append(kept, e)
+			}
+		}
+		scan.entries = kept
+	}
+	if req.Reproducible {
+		sort.Slice(scan.entries, func(i, j int) bool { return scan.entries[i].name < scan.entries[j].name })
+	}
+	return scan, nil
+}
+
+// walk adds the entries of dir (archive path rel) in name order. ancestors
+// holds the resolved paths of dir and every directory above it; included is
+// set when an include pattern matched dir or a directory above it.
+func (w *archiveWalker) walk(dir, rel string, ancestors []string, included bool) error {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range des {
+		path := filepath.Join(dir, d.Name())
+		r := d.Name()
+		if rel != "" {
+			r = rel + "/" + d.Name()
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		isLink := info.Mode()&fs.ModeSymlink != 0
+		isDir := info.IsDir()
+		if isLink && w.symlinks == symlinksFollow {
+			if st, serr := os.Stat(path); serr == nil {
+				isDir = st.IsDir()
+			}
+		}
+		if w.omit[filepath.Join(ancestors[len(ancestors)-1], d.Name())] {
+			continue
+		}
+		if w.filter.skip(r, isDir, included) {
+			if isDir {
+				w.scan.skippedDirs++
+			} else {
+				w.scan.skipped++
+			}
+			continue
+		}
+		e := archiveEntry{path: path, rel: r, name: filepath.ToSlash(filepath.Join(w.req.Prefix, r)), info: info}
+		real := filepath.Join(ancestors[len(ancestors)-1], d.Name())
+		if isLink {
+			if e, real, err = w.symlink(e, r, ancestors); err != nil {
+				return err
+			}
+		}
+		switch {
+		case e.info.IsDir():
+			w.scan.entries = append(w.scan.entries, e)
+			sub := included || w.filter.included(r, true)
+			if err := w.walk(path, r, append(ancestors[:len(ancestors):len(ancestors)], real), sub); err != nil {
+				return err
+			}
+		case e.link != "" || e.info.Mode().IsRegular():
+			w.scan.entries = append(w.scan.entries, e)
+			w.scan.included++
+		default:
+			// Sockets, devices and pipes have no archivable content.
+			w.scan.skipped++
+		}
+	}
+	return nil
+}
+
+// symlink applies the symlink policy to the link entry e at archive path
+// rel. It returns the entry to archive and, for a followed link, its
+// resolved target.
+func (w *archiveWalker) symlink(e archiveEntry, rel string, ancestors []string) (archiveEntry, string, error) {
+	fail := func(reason, format string, args ...interface{}) (archiveEntry, string, error) {
+		return e, "", &archiveError{reason: reason, err: fmt.Errorf(format, args...)}
+	}
+	if w.symlinks == symlinksReject {
+		return fail("symlink-rejected", "symlink %s is not allowed (symlinks: reject)", rel)
+	}
+	target, err := os.Readlink(e.path)
+	if err != nil {
+		return e, "", err
+	}
+	if w.symlinks == symlinksPreserve {
+		// The link must stay valid wherever the archive is unpacked.
+		if filepath.IsAbs(target) {
+			return fail("symlink-escape", "symlink %s has absolute target %s", rel, target)
+		}
+		lexical := filepath.Join(filepath.Dir(filepath.Join(w.root, filepath.FromSlash(rel))), target)
+		if !within(w.root, lexical) {
+			return fail("symlink-escape", "symlink %s points outside src (%s)", rel, target)
+		}
+		if real, err := filepath.EvalSymlinks(e.path); err == nil && !within(w.root, real) {
+			return fail("symlink-escape", "symlink %s resolves outside src (%s)", rel, real)
+		}
+		e.link = filepath.ToSlash(target)
+		return e, "", nil
+	}
+	st, err := os.Stat(e.path)
+	switch {
+	case errors.Is(err, syscall.ELOOP):
+		return fail("symlink-cycle", "symlink %s is part of a link loop", rel)
+	case err != nil:
+		return fail("symlink-broken", "symlink %s -> %s cannot be followed: %v", rel, target, err)
+	}
+	real, err := filepath.EvalSymlinks(e.path)
+	if err != nil {
+		return fail("symlink-broken", "symlink %s -> %s cannot be resolved: %v", rel, target, err)
+	}
+	if !within(w.root, real) {
+		return fail("symlink-escape", "symlink %s resolves outside src (%s)", rel, real)
+	}
+	if st.IsDir() {
+		for _, a := range ancestors {
+			if a == real {
+				return fail("symlink-cycle", "symlink %s -> %s loops back to a parent directory", rel, target)
+			}
+		}
+	}
+	e.info = st
+	return e, real, nil
+}
+
+// resolvedPath returns the absolute form of p with symlinks in its parent
+// directory resolved, matching the paths the walker builds.
+func resolvedPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		return filepath.Join(dir, filepath.Base(abs))
+	}
+	return abs
+}
+
+// pathDir is path.Dir for archive names, returning "" at the top level.
+func pathDir(name string) string {
+	if i := strings.LastIndexByte(name, '/'); i > 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// reproducibleEpoch is the latest mtime written in reproducible mode:
+// $SOURCE_DATE_EPOCH, or 1980-01-01 (the earliest time zip can store).
+func reproducibleEpoch() (time.Time, error) {
+	if v := os.Getenv("SOURCE_DATE_EPOCH"); v != "" {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || secs < 0 {
+			return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", v)
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+// normalizedEntry returns the mode and mtime an entry gets in reproducible
+// mode: 0755 for directories and executables, 0777 for symlinks, 0644
+// otherwise, and the mtime
+// clamped to epoch at whole-second precision.
+func normalizedEntry(info fs.FileInfo, epoch time.Time) (fs.FileMode, time.Time) {
+	mode := fs.FileMode(0o644)
+	if info.Mode()&fs.ModeSymlink != 0 {
+		mode = 0o777
+	} else if info.IsDir() || info.Mode().Perm()&0o111 != 0 {
+		mode = 0o755
+	}
+	mtime := info.ModTime().UTC().Truncate(time.Second)
+	if mtime.After(epoch) {
+		mtime = epoch
+	}
+	return mode, mtime
+}
+
+func archiveFail(stdout io.Writer, msg, reason string) bool {
+	ok := false
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: msg})
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: reason})
+	return false
+}
+
+// archiveDone writes the final event shared by zip-dir, tar-dir and
+// manifest, adding extra to done.extra. scan is nil when the failure happened
+// before the source was walked.
+func archiveDone(req runRequest, scan *archiveScan, extra map[string]interface{}, err error, stdout io.Writer) bool {
+	ok := err == nil
+	reason := ""
+	if !ok {
+		var ae *archiveError
+		if errors.As(err, &ae) {
+			reason = ae.reason
+		}
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error(), Reason: reason})
+	}
+	if extra == nil {
+		extra = map[string]interface{}{}
+	}
+	extra["dest"] = req.Dest
+	if scan != nil {
+		extra["included"] = scan.included
+		extra["skipped"] = scan.skipped
+		extra["skippedDirs"] = scan.skippedDirs
+	}
+	if req.Reproducible {
+		extra["reproducible"] = true
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(map[bool]int{true: 0, false: 1}[ok]), Final: boolPtr(true), Reason: reason, Extra: extra})
+	return ok
+}
+
+// zipDir creates a deflated zip archive of req.Src at req.Dest.
+func zipDir(req runRequest, stdout io.Writer) bool {
+	if req.Src == "" || req.Dest == "" {
+		return archiveFail(stdout, "zip-dir: src and dest required", "invalid-args")
+	}
+	switch req.Symlinks {
+	case "", symlinksFollow, symlinksPreserve, symlinksReject:
+	default:
+		return archiveFail(stdout, "zip-dir: symlinks must be follow, preserve or reject", "invalid-args")
+	}
+	var epoch time.Time
+	if req.Reproducible {
+		var err error
+		if epoch, err = reproducibleEpoch(); err != nil {
+			return archiveFail(stdout, err.Error(), "invalid-args")
+		}
+	}
+	filter, err := loadArchiveFilter(req)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "invalid-args")
+	}
+	manifest, err := archiveManifest(req)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "invalid-args")
+	}
+	policy, err := newCompressionPolicy(req, zipDeflateLevel)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "invalid-args")
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "zipping"})
+	f, err := createArchiveFile(req.Dest)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "")
+	}
+	zw := zip.NewWriter(f)
+	scan, err := collectEntries(req, filter, req.Dest, f.Name(), sidecarManifestPath(req.Dest))
+	if err == nil {
+		err = checkManifestName(req, scan)
+	}
+	var progress *progressMeter
+	var stats compressionStats
+	if err == nil {
+		progress = scanProgress(stdout, "zipping", scan)
+		stats, err = writeZipEntries(zw, scan.entries, req, epoch, manifest, progress, policy)
+	}
+	if err == nil && req.Manifest == manifestEmbed {
+		err = embedManifestZip(zw, manifest, req, epoch)
+	}
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	extra, err := finishArchive(f, req, manifest, err)
+	if err == nil {
+		progress.finish()
+		if extra == nil {
+			extra = map[string]interface{}{}
+		}
+		stats.addTo(extra, policy.level)
+		extra["storedFiles"] = stats.stored
+	}
+	return archiveDone(req, scan, extra, err, stdout)
+}
+
+// writeZipEntries adds entries to zw in order while a pool of workers
+// compresses the files ahead of it following policy, recording file hashes
+// in manifest and counting files and bytes in progress when they are not
+// nil. It returns the sizes of the file data before and after compression.
+func writeZipEntries(zw *zip.Writer, entries []archiveEntry, req runRequest, epoch time.Time, manifest *deployManifest, progress *progressMeter, policy *compressionPolicy) (compressionStats, error) {
+	pool := startZipPool(entries, zipWorkers(req), filepath.Dir(req.Dest), manifest != nil, progress, policy)
+	defer pool.stop()
+	var stats compressionStats
+	var err error
+	for i, e := range entries {
+		var hdr *zip.FileHeader
+		if req.Reproducible {
+			mode, mtime := normalizedEntry(e.info, epoch)
+			hdr = &zip.FileHeader{Name: e.name, Modified: mtime}
+			hdr.SetMode(mode | e.info.Mode().Type()&(fs.ModeDir|fs.ModeSymlink))
+		} else if hdr, err = zip.FileInfoHeader(e.info); err != nil {
+			return stats, err
+		}
+		hdr.Name = e.name
+		if e.info.IsDir() {
+			// Directory entries end with / and carry no data.
+			if !strings.HasSuffix(hdr.Name, "/") {
+				hdr.Name += "/"
+			}
+			hdr.Method = zip.Store
+			if _, err := zw.CreateHeader(hdr); err != nil {
+				return stats, err
+			}
+			continue
+		}
+		if e.link != "" {
+			// Preserved symlinks store their target as the entry data.
+			hdr.Method = zip.Store
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return stats, err
+			}
+			if err := writeEntryData(w, e, manifest, req, epoch); err != nil {
+				return stats, err
+			}
+			progress.fileDone()
+			continue
+		}
+		job := pool.wait(i)
+		if job.err != nil {
+			return stats, job.err
+		}
+		stats.size += job.size
+		stats.compressed += job.data.size
+		if job.method == zip.Store {
+			stats.stored++
+		}
+		if err := job.writeRaw(zw, hdr); err != nil {
+			return stats, err
+		}
+		if manifest != nil {
+			manifest.add(e, job.digest, req, epoch)
+		}
+		progress.fileDone()
+	}
+	return stats, nil
+}
+
+// tarDir creates a tar (optionally gzipped) archive of req.Src at req.Dest.
+func tarDir(req runRequest, stdout io.Writer) bool {
+	if req.Src == "" || req.Dest == "" {
+		return archiveFail(stdout, "tar-dir: src and dest required", "invalid-args")
+	}
+	switch req.Symlinks {
+	case "", symlinksFollow, symlinksPreserve, symlinksReject:
+	default:
+		return archiveFail(stdout, "tar-dir: symlinks must be follow, preserve or reject", "invalid-args")
+	}
+	var epoch time.Time
+	if req.Reproducible {
+		var err error
+		if epoch, err = reproducibleEpoch(); err != nil {
+			return archiveFail(stdout, err.Error(), "invalid-args")
+		}
+	}
+	filter, err := loadArchiveFilter(req)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "invalid-args")
+	}
+	manifest, err := archiveManifest(req)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "invalid-args")
+	}
+	policy, err := newCompressionPolicy(req, gzipDefaultLevel)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "invalid-args")
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "tarring"})
+	f, err := createArchiveFile(req.Dest)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "")
+	}
+	var out io.Writer = f
+	var gw *gzip.Writer
+	var tarred, gzipped *byteCounter
+	if req.TarGz {
+		// The gzip header's name and mtime stay empty, so it is stable too.
+		gzipped = &byteCounter{w: f}
+		gw, _ = gzip.NewWriterLevel(gzipped, policy.level)
+		tarred = &byteCounter{w: gw}
+		out = tarred
+	}
+	tw := tar.NewWriter(out)
+	scan, err := collectEntries(req, filter, req.Dest, f.Name(), sidecarManifestPath(req.Dest))
+	if err == nil {
+		err = checkManifestName(req, scan)
+	}
+	var progress *progressMeter
+	if err == nil {
+		progress = scanProgress(stdout, "tarring", scan)
+		err = writeTarEntries(tw, scan.entries, req, epoch, manifest, progress)
+	}
+	if err == nil && req.Manifest == manifestEmbed {
+		err = embedManifestTar(tw, manifest, req, epoch)
+	}
+	if cerr := tw.Close(); err == nil {
+		err = cerr
+	}
+	if gw != nil {
+		if cerr := gw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	extra, err := finishArchive(f, req, manifest, err)
+	if err == nil {
+		progress.finish()
+		if gw != nil {
+			if extra == nil {
+				extra = map[string]interface{}{}
+			}
+			compressionStats{size: tarred.n, compressed: gzipped.n}.addTo(extra, policy.level)
+		}
+	}
+	return archiveDone(req, scan, extra, err, stdout)
+}
+
+// writeTarEntries adds entries to tw, recording file hashes in manifest
+// and counting files and bytes in progress when they are not nil.
+func writeTarEntries(tw *tar.Writer, entries []archiveEntry, req runRequest, epoch time.Time, manifest *deployManifest, progress *progressMeter) error {
+	var err error
+	for _, e := range entries {
+		var hdr *tar.Header
+		if req.Reproducible {
+			// Built from scratch so no uid/gid, owner names or atime/ctime
+			// from the host leak into the header.
+			mode, mtime := normalizedEntry(e.info, epoch)
+			hdr = &tar.Header{Name: e.name, Mode: int64(mode), ModTime: mtime, Typeflag: tar.TypeReg, Size: e.info.Size()}
+			switch {
+			case e.info.IsDir():
+				hdr.Typeflag = tar.TypeDir
+				hdr.Size = 0
+			case e.link != "":
+				hdr.Typeflag = tar.TypeSymlink
+				hdr.Linkname = e.link
+				hdr.Size = 0
+			}
+		} else if hdr, err = tar.FileInfoHeader(e.info, e.link); err != nil {
+			return err
+		}
+		hdr.Name = e.name
+		if e.info.IsDir() && !strings.HasSuffix(hdr.Name, "/") {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if e.info.IsDir() {
+			continue
+		}
+		if e.link != "" {
+			// Only hashed: a tar symlink carries no data.
+			if manifest != nil {
+				if err := writeEntryData(io.Discard, e, manifest, req, epoch); err != nil {
+					return err
+				}
+			}
+			progress.fileDone()
+			continue
+		}
+		if err := writeEntryData(progress.wrap(tw), e, manifest, req, epoch); err != nil {
+			return err
+		}
+		progress.fileDone()
+	}
+	return nil
+}
+
+// archiveFile is an archive being written to a temp file next to its
+// destination, so dest is either the previous file or the complete new one.
+// An interrupt or SIGTERM while it is open removes the temp file.
+type archiveFile struct {
+	*os.File
+	dest string
+	stop func()
+}
+
+func createArchiveFile(dest string) (*archiveFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{File: f, dest: dest, stop: removeOnSignal(f.Name())}, nil
+}
+
+// finish renames the temp file over dest when err is nil and removes it
+// otherwise. It returns err or the error from completing the file.
+func (a *archiveFile) finish(err error) error {
+	a.stop()
+	if cerr := a.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(a.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(a.Name(), a.dest)
+	}
+	if err != nil {
+		_ = os.Remove(a.Name())
+	}
+	return err
+}
+
+// removeOnSignal deletes path and exits with 130 if the sidecar receives an
+// interrupt or SIGTERM before the returned stop function is called.
+func removeOnSignal(path string) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			_ = os.RemoveAll(path)
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// writeEntryData writes the content of a file or preserved link entry to w,
+// hashing it into manifest when one is being built.
+func writeEntryData(w io.Writer, e archiveEntry, manifest *deployManifest, req runRequest, epoch time.Time) error {
+	if manifest != nil {
+		return digestEntry(w, e, manifest, req, epoch)
+	}
+	if e.link != "" {
+		_, err := io.WriteString(w, e.link)
+		return err
+	}
+	return copyFileTo(w, e.path)
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,962 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// goldenTarSHA256 is the digest of the reproducible plain tar of the tree
+// built by writeGoldenTree with SOURCE_DATE_EPOCH unset.
+const goldenTarSHA256 = "dde7a1600ce22527ae59477329a25297a251b8788f0af982c9dbb787d6e9d0d9"
+
+// writeGoldenTree creates the same files under dir with the given file mode
+// and mtime, so two trees differ only in metadata.
+func writeGoldenTree(t *testing.T, dir string, perm os.FileMode, mtime time.Time) {
+	t.Helper()
+	files := map[string]string{
+		"index.html":        "<h1>hello</h1>\n",
+		"assets/app.js":     "console.log('hi')\n",
+		"assets/app-b.css":  "body{}\n",
+		"assets-z/logo.svg": "<svg/>\n",
+		"bin/run.sh":        "#!/bin/sh\necho run\n",
+	}
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		mode := perm
+		if filepath.Ext(name) == ".sh" {
+			mode |= 0o100
+		}
+		if err := os.WriteFile(p, []byte(body), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Touch directories last so file writes don't reset their mtimes.
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(p, mtime, mtime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// archiveDigest builds an archive of src with the given action and returns
+// the sha256 of the result.
+func archiveDigest(t *testing.T, action, src string, gz bool) string {
+	t.Helper()
+	dest := filepath.Join(t.TempDir(), "out")
+	req := runRequest{Action: action, Src: src, Dest: dest, Prefix: "site", TarGz: gz, Reproducible: true}
+	var ok bool
+	if action == "zip-dir" {
+		ok = zipDir(req, io.Discard)
+	} else {
+		ok = tarDir(req, io.Discard)
+	}
+	if !ok {
+		t.Fatalf("%s failed", action)
+	}
+	sum, _, err := hashFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+func TestReproducibleArchives(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	a, b := t.TempDir(), t.TempDir()
+	writeGoldenTree(t, a, 0o644, time.Now())
+	writeGoldenTree(t, b, 0o600, time.Now().Add(-48*time.Hour))
+
+	cases := []struct {
+		name   string
+		action string
+		gz     bool
+	}{
+		{"zip", "zip-dir", false},
+		{"tar", "tar-dir", false},
+		{"tar.gz", "tar-dir", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			first := archiveDigest(t, tc.action, a, tc.gz)
+			if again := archiveDigest(t, tc.action, a, tc.gz); again != first {
+				t.Errorf("second run digest %s, want %s", again, first)
+			}
+			if other := archiveDigest(t, tc.action, b, tc.gz); other != first {
+				t.Errorf("digest of copy with different metadata %s, want %s", other, first)
+			}
+			if tc.name == "tar" && first != goldenTarSHA256 {
+				t.Errorf("tar digest %s, want golden %s", first, goldenTarSHA256)
+			}
+		})
+	}
+}
+
+func TestReproducibleSourceDateEpoch(t *testing.T) {
+	src := t.TempDir()
+	writeGoldenTree(t, src, 0o644, time.Now())
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	base := archiveDigest(t, "tar-dir", src, false)
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	withEpoch := archiveDigest(t, "tar-dir", src, false)
+	if withEpoch == base {
+		t.Fatal("SOURCE_DATE_EPOCH did not change the archive")
+	}
+	other := t.TempDir()
+	writeGoldenTree(t, other, 0o600, time.Now().Add(time.Hour))
+	if got := archiveDigest(t, "tar-dir", other, false); got != withEpoch {
+		t.Errorf("digest %s, want %s", got, withEpoch)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "not-a-number")
+	if tarDir(runRequest{Src: src, Dest: filepath.Join(t.TempDir(), "x.tar"), Reproducible: true}, io.Discard) {
+		t.Error("invalid SOURCE_DATE_EPOCH accepted")
+	}
+}
+
+// finalEvent runs an action and returns its done event.
+func finalEvent(t *testing.T, run func(runRequest, io.Writer) bool, req runRequest) ndjsonEvent {
+	t.Helper()
+	var out bytes.Buffer
+	run(req, &out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	var ev ndjsonEvent
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &ev); err != nil || ev.Event != "done" {
+		t.Fatalf("no done event in %q", out.String())
+	}
+	return ev
+}
+
+// tarEntry describes one member of a test archive. Entries with a link
+// become symlinks, or hard links when hard is set.
+type tarEntry struct {
+	name string
+	body string
+	link string
+	hard bool
+	size int64 // declared size when non-zero
+}
+
+func writeTestTar(t *testing.T, entries []tarEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		switch {
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0o755
+		case e.link != "" && e.hard:
+			hdr.Typeflag, hdr.Linkname = tar.TypeLink, e.link
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "test.tar")
+	if err := os.WriteFile(p, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func writeTestZip(t *testing.T, entries []tarEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Store}
+		body := e.body
+		if e.link != "" {
+			hdr.SetMode(os.ModeSymlink | 0o777)
+			body = e.link
+		}
+		if e.size != 0 {
+			// A lying header: stored data is small, declared size is not.
+			w, err := zw.CreateRaw(&zip.FileHeader{Name: e.name, Method: zip.Store, CompressedSize64: uint64(len(body)), UncompressedSize64: uint64(e.size)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, body)
+			continue
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, body)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "test.zip")
+	if err := os.WriteFile(p, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestUnpackRejects(t *testing.T) {
+	cases := []struct {
+		name    string
+		zip     bool
+		entries []tarEntry
+		req     runRequest
+		reason  string
+	}{
+		{name: "tar slip", entries: []tarEntry{{name: "../evil", body: "x"}}, reason: "unsafe-path"},
+		{name: "tar nested slip", entries: []tarEntry{{name: "a/../../evil", body: "x"}}, reason: "unsafe-path"},
+		{name: "tar absolute", entries: []tarEntry{{name: "/tmp/evil", body: "x"}}, reason: "unsafe-path"},
+		{name: "tar drive letter", entries: []tarEntry{{name: "C:/evil", body: "x"}}, reason: "unsafe-path"},
+		{name: "symlink absolute", entries: []tarEntry{{name: "l", link: "/etc/passwd"}}, reason: "unsafe-path"},
+		{name: "symlink escape", entries: []tarEntry{{name: "a/l", link: "../../x"}}, reason: "unsafe-path"},
+		{name: "symlink dot-dot after link", entries: []tarEntry{{name: "d", link: "."}, {name: "e", link: "d/d/d/../.."}}, reason: "unsafe-path"},
+		{name: "write through symlink", entries: []tarEntry{{name: "a/", body: ""}, {name: "l", link: "a"}, {name: "l/../../x", body: "x"}}, reason: "unsafe-path"},
+		{name: "hardlink escape", entries: []tarEntry{{name: "h", link: "../outside", hard: true}}, reason: "unsafe-path"},
+		{name: "hardlink missing", entries: []tarEntry{{name: "h", link: "nope", hard: true}}, reason: "unsafe-path"},
+		{name: "hardlink through symlink", entries: []tarEntry{{name: "l", link: "."}, {name: "h", link: "l/../../outside", hard: true}}, reason: "unsafe-path"},
+		{name: "tar entry limit", entries: []tarEntry{{name: "a", body: "1"}, {name: "b", body: "2"}, {name: "c", body: "3"}}, req: runRequest{MaxEntries: 2}, reason: "limit-exceeded"},
+		{name: "tar byte limit", entries: []tarEntry{{name: "a", body: "0123456789"}}, req: runRequest{MaxBytes: 5}, reason: "limit-exceeded"},
+		{name: "zip slip", zip: true, entries: []tarEntry{{name: "../evil", body: "x"}}, reason: "unsafe-path"},
+		{name: "zip backslash slip", zip: true, entries: []tarEntry{{name: `..\evil`, body: "x"}}, reason: "unsafe-path"},
+		{name: "zip symlink escape", zip: true, entries: []tarEntry{{name: "l", link: "../x"}}, reason: "unsafe-path"},
+		{name: "zip declared size", zip: true, entries: []tarEntry{{name: "bomb", body: "x", size: 1 << 40}}, reason: "limit-exceeded"},
+		{name: "zip entry limit", zip: true, entries: []tarEntry{{name: "a", body: "1"}, {name: "b", body: "2"}}, req: runRequest{MaxEntries: 1}, reason: "limit-exceeded"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			parent := t.TempDir()
+			req := tc.req
+			req.Dest = filepath.Join(parent, "out")
+			run := untarArchive
+			if tc.zip {
+				req.Src, run = writeTestZip(t, tc.entries), unzipArchive
+			} else {
+				req.Src = writeTestTar(t, tc.entries)
+			}
+			ev := finalEvent(t, run, req)
+			if *ev.OK || ev.Reason != tc.reason {
+				t.Fatalf("ok=%v reason=%q, want failure with %q", *ev.OK, ev.Reason, tc.reason)
+			}
+			// Nothing may be left behind: not dest, not a temp dir, not
+			// anything written next to it.
+			if des, _ := os.ReadDir(parent); len(des) != 0 {
+				t.Errorf("left %d entries next to dest", len(des))
+			}
+		})
+	}
+
+	t.Run("invalid archive", func(t *testing.T) {
+		src := filepath.Join(t.TempDir(), "bad.tar.gz")
+		os.WriteFile(src, []byte{0x1f, 0x8b, 0, 1, 2}, 0o644)
+		ev := finalEvent(t, untarArchive, runRequest{Src: src, Dest: filepath.Join(t.TempDir(), "out")})
+		if ev.Reason != "invalid-archive" {
+			t.Fatalf("reason %q, want invalid-archive", ev.Reason)
+		}
+	})
+}
+
+func TestUnpackExistingDestLinks(t *testing.T) {
+	dest := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dest, "out")); err != nil {
+		t.Fatal(err)
+	}
+	for _, entries := range [][]tarEntry{
+		{{name: "out/x", body: "x"}},
+		{{name: "l", link: "out/x"}},
+	} {
+		ev := finalEvent(t, untarArchive, runRequest{Src: writeTestTar(t, entries), Dest: dest})
+		if *ev.OK || ev.Reason != "unsafe-path" {
+			t.Errorf("%s: ok=%v reason=%q, want unsafe-path", entries[0].name, *ev.OK, ev.Reason)
+		}
+	}
+	if des, _ := os.ReadDir(outside); len(des) != 0 {
+		t.Errorf("wrote %d entries outside dest", len(des))
+	}
+}
+
+func TestUnpackAllowsSafeLinks(t *testing.T) {
+	src := writeTestTar(t, []tarEntry{
+		{name: "a/", body: ""},
+		{name: "a/f", body: "data"},
+		{name: "a/up", link: "../a/f"},
+		{name: "cur", link: "."},
+		{name: "h", link: "a/f", hard: true},
+	})
+	dest := filepath.Join(t.TempDir(), "out")
+	ev := finalEvent(t, untarArchive, runRequest{Src: src, Dest: dest})
+	if !*ev.OK {
+		t.Fatalf("untar failed: %+v", ev)
+	}
+	if b, err := os.ReadFile(filepath.Join(dest, "a", "up")); err != nil || string(b) != "data" {
+		t.Errorf("a/up = %q, %v", b, err)
+	}
+}
+
+// archiveNames returns the sorted member names of a zip.
+func archiveNames(t *testing.T, p string) []string {
+	t.Helper()
+	zr, err := zip.OpenReader(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestArchiveRejects(t *testing.T) {
+	cases := []struct {
+		name   string
+		setup  func(t *testing.T, src string)
+		req    runRequest
+		reason string
+	}{
+		{name: "bad symlinks value", req: runRequest{Symlinks: "copy"}, reason: "invalid-args"},
+		{name: "negated include", req: runRequest{Include: []string{"!*.js"}}, reason: "invalid-args"},
+		{name: "bad exclude", req: runRequest{Exclude: []string{"[a"}}, reason: "invalid-args"},
+		{name: "bad opdignore", setup: func(t *testing.T, src string) {
+			os.WriteFile(filepath.Join(src, opdIgnoreFile), []byte("[a\n"), 0o644)
+		}, reason: "invalid-args"},
+		{name: "reject", setup: func(t *testing.T, src string) {
+			os.Symlink("f", filepath.Join(src, "l"))
+		}, req: runRequest{Symlinks: symlinksReject}, reason: "symlink-rejected"},
+		{name: "preserve escape", setup: func(t *testing.T, src string) {
+			os.Symlink("../outside", filepath.Join(src, "l"))
+		}, req: runRequest{Symlinks: symlinksPreserve}, reason: "symlink-escape"},
+		{name: "preserve absolute", setup: func(t *testing.T, src string) {
+			os.Symlink(filepath.Join(src, "f"), filepath.Join(src, "l"))
+		}, req: runRequest{Symlinks: symlinksPreserve}, reason: "symlink-escape"},
+		{name: "follow escape", setup: func(t *testing.T, src string) {
+			os.Symlink(t.TempDir(), filepath.Join(src, "l"))
+		}, reason: "symlink-escape"},
+		{name: "follow loop", setup: func(t *testing.T, src string) {
+			os.Symlink(".", filepath.Join(src, "l"))
+		}, reason: "symlink-cycle"},
+		{name: "follow self loop", setup: func(t *testing.T, src string) {
+			os.Symlink("l", filepath.Join(src, "l"))
+		}, reason: "symlink-cycle"},
+		{name: "follow broken", setup: func(t *testing.T, src string) {
+			os.Symlink("missing", filepath.Join(src, "l"))
+		}, reason: "symlink-broken"},
+	}
+	for _, tc := range cases {
+		for _, action := range []string{"zip-dir", "tar-dir"} {
+			t.Run(tc.name+"/"+action, func(t *testing.T) {
+				src := t.TempDir()
+				os.WriteFile(filepath.Join(src, "f"), []byte("f"), 0o644)
+				if tc.setup != nil {
+					tc.setup(t, src)
+				}
+				parent := t.TempDir()
+				req := tc.req
+				req.Src, req.Dest = src, filepath.Join(parent, "out")
+				run := zipDir
+				if action == "tar-dir" {
+					run = tarDir
+				}
+				ev := finalEvent(t, run, req)
+				if *ev.OK || ev.Reason != tc.reason {
+					t.Fatalf("ok=%v reason=%q, want failure with %q", *ev.OK, ev.Reason, tc.reason)
+				}
+				if des, _ := os.ReadDir(parent); len(des) != 0 {
+					t.Errorf("left %d files next to dest", len(des))
+				}
+			})
+		}
+	}
+}
+
+func TestArchiveFilters(t *testing.T) {
+	src := t.TempDir()
+	for name, body := range map[string]string{
+		"index.html":     "",
+		"app.log":        "",
+		"keep.log":       "",
+		"src/a.js":       "",
+		"src/a.test.js":  "",
+		"node_modules/m": "",
+		"build/cache/x":  "",
+		opdIgnoreFile:    "*.log\n!keep.log\nnode_modules/\n/build/cache/\n",
+	} {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		os.WriteFile(p, []byte(body), 0o644)
+	}
+	// dest inside src: the archive must never contain itself or its temp file.
+	dest := filepath.Join(src, "site.zip")
+	ev := finalEvent(t, zipDir, runRequest{Src: src, Dest: dest, Exclude: []string{"*.test.js"}, Reproducible: true})
+	if !*ev.OK {
+		t.Fatalf("zip-dir failed: %+v", ev)
+	}
+	got := strings.Join(archiveNames(t, dest), " ")
+	if want := "build/ index.html keep.log src/ src/a.js"; got != want {
+		t.Errorf("entries %q, want %q", got, want)
+	}
+	if n := ev.Extra["included"].(float64); n != 3 {
+		t.Errorf("included %v, want 3", n)
+	}
+
+	// Rebuilding over the previous archive must not pick it up either.
+	ev = finalEvent(t, zipDir, runRequest{Src: src, Dest: dest, Include: []string{"src/**"}, Reproducible: true})
+	if got := strings.Join(archiveNames(t, dest), " "); !*ev.OK || got != "src/ src/a.js src/a.test.js" {
+		t.Errorf("include: ok=%v entries %q", *ev.OK, got)
+	}
+
+	// A directory matched by include brings in everything below it.
+	for _, tc := range []struct {
+		include, exclude []string
+		want             string
+	}{
+		{[]string{"src"}, nil, "src/ src/a.js src/a.test.js"},
+		{[]string{"src/"}, nil, "src/ src/a.js src/a.test.js"},
+		{[]string{"src/"}, []string{"*.test.js"}, "src/ src/a.js"},
+		{[]string{"index.html/"}, nil, ""},
+	} {
+		ev = finalEvent(t, zipDir, runRequest{Src: src, Dest: dest, Include: tc.include, Exclude: tc.exclude, Reproducible: true})
+		if got := strings.Join(archiveNames(t, dest), " "); !*ev.OK || got != tc.want {
+			t.Errorf("include %q exclude %q: ok=%v entries %q, want %q", tc.include, tc.exclude, *ev.OK, got, tc.want)
+		}
+	}
+}
+
+func TestArchiveProgress(t *testing.T) {
+	src := t.TempDir()
+	writeGoldenTree(t, src, 0o644, time.Now())
+	for _, action := range []string{"zip-dir", "tar-dir", "manifest"} {
+		run := map[string]func(runRequest, io.Writer) bool{"zip-dir": zipDir, "tar-dir": tarDir, "manifest": writeManifest}[action]
+		var out bytes.Buffer
+		if !run(runRequest{Action: action, Src: src, Dest: filepath.Join(t.TempDir(), "out")}, &out) {
+			t.Fatalf("%s failed: %s", action, out.String())
+		}
+		// The closing progress event always reports the pre-scanned totals.
+		var last *ndjsonEvent
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var ev ndjsonEvent
+			if json.Unmarshal([]byte(line), &ev) == nil && ev.Event == "progress" {
+				last = &ev
+			}
+		}
+		if last == nil {
+			t.Fatalf("%s: no progress event", action)
+		}
+		x := last.Extra
+		if x["files"] != x["totalFiles"] || x["files"].(float64) != 5 || x["bytes"] != x["totalBytes"] || x["percent"].(float64) != 100 {
+			t.Errorf("%s: final progress %v", action, x)
+		}
+	}
+}
+
+// writeZipSequential is the single-goroutine writer zip-dir used before the
+// worker pool: every file streamed through CreateHeader. It is the reference
+// the pool must match byte for byte and the baseline for BenchmarkZipDir.
+func writeZipSequential(zw *zip.Writer, entries []archiveEntry) error {
+	for _, e := range entries {
+		hdr, err := zip.FileInfoHeader(e.info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = e.name
+		if e.info.IsDir() {
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+			if _, err := zw.CreateHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		hdr.Method = zip.Deflate
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err := copyFileTo(w, e.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeZipTree builds a tree of n files of roughly size bytes each, half
+// compressible text and half random data, plus an empty file and one with a
+// non-ASCII name.
+func writeZipTree(tb testing.TB, dir string, n, size int) {
+	tb.Helper()
+	rnd := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(rnd)
+	text := bytes.Repeat([]byte("export const chunk = () => import('./page.js');\n"), size/48+1)[:size]
+	for i := 0; i < n; i++ {
+		body := text
+		if i%2 == 1 {
+			body = rnd
+		}
+		p := filepath.Join(dir, "chunks", fmt.Sprint(i%7), fmt.Sprintf("%03d.js", i))
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		if err := os.WriteFile(p, body, 0o644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "empty.txt"), nil, 0o644)
+	os.WriteFile(filepath.Join(dir, "café.html"), text[:100], 0o644)
+}
+
+func zipWith(tb testing.TB, entries []archiveEntry, dest string, write func(*zip.Writer, []archiveEntry) error) {
+	tb.Helper()
+	f, err := os.Create(dest)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	err = write(zw, entries)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestZipPoolMatchesSequential(t *testing.T) {
+	src := t.TempDir()
+	writeZipTree(t, src, 40, 64<<10)
+	// One entry large enough to be spooled to disk.
+	big := make([]byte, zipSpoolLimit+1<<20)
+	rand.New(rand.NewSource(2)).Read(big)
+	os.WriteFile(filepath.Join(src, "big.bin"), big, 0o644)
+	scan, err := collectEntries(runRequest{Src: src}, &archiveFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	want := filepath.Join(out, "sequential.zip")
+	zipWith(t, scan.entries, want, writeZipSequential)
+	wantSum, _, _ := hashFile(want)
+	policy, _ := newCompressionPolicy(runRequest{}, zipDeflateLevel)
+	for _, workers := range []int{1, 3, 8} {
+		dest := filepath.Join(out, "pool.zip")
+		req := runRequest{Src: src, Dest: dest, Concurrency: workers}
+		zipWith(t, scan.entries, dest, func(zw *zip.Writer, entries []archiveEntry) error {
+			_, err := writeZipEntries(zw, entries, req, time.Time{}, nil, nil, policy)
+			return err
+		})
+		if sum, _, _ := hashFile(dest); sum != wantSum {
+			t.Errorf("workers=%d: archive differs from the sequential writer", workers)
+		}
+	}
+	if des, _ := os.ReadDir(out); len(des) != 2 {
+		t.Errorf("%d files in dest dir, want no spool files left", len(des))
+	}
+}
+
+// BenchmarkZipDir compares the sequential writer with the worker pool on a
+// tree of 200 files of 256KiB.
+func BenchmarkZipDir(b *testing.B) {
+	src := b.TempDir()
+	writeZipTree(b, src, 200, 256<<10)
+	scan, err := collectEntries(runRequest{Src: src}, &archiveFilter{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var total int64
+	for _, e := range scan.entries {
+		if !e.info.IsDir() {
+			total += e.info.Size()
+		}
+	}
+	dest := filepath.Join(b.TempDir(), "out.zip")
+	policy, _ := newCompressionPolicy(runRequest{}, zipDeflateLevel)
+	b.Run("sequential", func(b *testing.B) {
+		b.SetBytes(total)
+		for i := 0; i < b.N; i++ {
+			zipWith(b, scan.entries, dest, writeZipSequential)
+		}
+	})
+	for _, workers := range []int{1, 2, 4, 8} {
+		req := runRequest{Src: src, Dest: dest, Concurrency: workers}
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			b.SetBytes(total)
+			for i := 0; i < b.N; i++ {
+				zipWith(b, scan.entries, dest, func(zw *zip.Writer, entries []archiveEntry) error {
+					_, err := writeZipEntries(zw, entries, req, time.Time{}, nil, nil, policy)
+					return err
+				})
+			}
+		})
+	}
+}
+
+func TestZipCompressionPolicy(t *testing.T) {
+	src := t.TempDir()
+	noise := make([]byte, 32<<10)
+	rand.New(rand.NewSource(3)).Read(noise)
+	text := bytes.Repeat([]byte("body { margin: 0 }\n"), 1000)
+	os.WriteFile(filepath.Join(src, "logo.PNG"), text, 0o644)
+	os.WriteFile(filepath.Join(src, "noise.bin"), noise, 0o644)
+	os.WriteFile(filepath.Join(src, "site.css"), text, 0o644)
+
+	for _, tc := range []struct {
+		name   string
+		req    runRequest
+		stored string // entries expected to be stored, space separated
+	}{
+		{"defaults", runRequest{}, "logo.PNG"},
+		{"no store list", runRequest{StoreExtensions: []string{}}, ""},
+		{"custom list", runRequest{StoreExtensions: []string{"css", ".bin"}}, "noise.bin site.css"},
+		{"threshold", runRequest{StoreThreshold: 0.05}, "logo.PNG noise.bin"},
+		{"threshold and level", runRequest{StoreThreshold: 0.05, CompressionLevel: 9, Concurrency: 1}, "logo.PNG noise.bin"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := tc.req
+			req.Src, req.Dest = src, filepath.Join(t.TempDir(), "out.zip")
+			ev := finalEvent(t, zipDir, req)
+			if !*ev.OK {
+				t.Fatalf("zip-dir failed: %+v", ev)
+			}
+			zr, err := zip.OpenReader(req.Dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			var stored []string
+			for _, f := range zr.File {
+				if f.Method == zip.Store {
+					stored = append(stored, f.Name)
+				}
+				// Reading to the end checks the CRC of every entry.
+				rc, _ := f.Open()
+				if _, err := io.Copy(io.Discard, rc); err != nil {
+					t.Errorf("%s: %v", f.Name, err)
+				}
+				rc.Close()
+			}
+			if got := strings.Join(stored, " "); got != tc.stored {
+				t.Errorf("stored %q, want %q", got, tc.stored)
+			}
+			x := ev.Extra
+			if int(x["storedFiles"].(float64)) != len(stored) || x["ratio"].(float64) <= 0 || x["ratio"].(float64) >= 1 {
+				t.Errorf("done.extra %v", x)
+			}
+		})
+	}
+
+	for _, req := range []runRequest{{CompressionLevel: 10}, {CompressionLevel: -1}, {StoreThreshold: 1}, {StoreThreshold: -0.1}} {
+		req.Src, req.Dest = src, filepath.Join(t.TempDir(), "out.zip")
+		if ev := finalEvent(t, zipDir, req); *ev.OK || ev.Reason != "invalid-args" {
+			t.Errorf("%+v accepted", req)
+		}
+	}
+}
+
+func TestListArchive(t *testing.T) {
+	src := t.TempDir()
+	for name, size := range map[string]int{"a.js": 300, "b.js": 100, "c.css": 200, "README": 50, "sub/d.js": 400} {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		os.WriteFile(p, bytes.Repeat([]byte("x"), size), 0o644)
+	}
+	// A preserved link is listed but not counted as file content.
+	if err := os.Symlink("a.js", filepath.Join(src, "link.js")); err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{"zip-dir", "tar-dir"} {
+		t.Run(action, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "out")
+			req := runRequest{Src: src, Dest: dest, TarGz: true, Symlinks: symlinksPreserve}
+			if ok := map[string]func(runRequest, io.Writer) bool{"zip-dir": zipDir, "tar-dir": tarDir}[action](req, io.Discard); !ok {
+				t.Fatalf("%s failed", action)
+			}
+			var out bytes.Buffer
+			if !listArchive(runRequest{Src: dest, Top: 2}, &out) {
+				t.Fatalf("archive-list failed: %s", out.String())
+			}
+			var entries int
+			var done ndjsonEvent
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				var ev ndjsonEvent
+				json.Unmarshal([]byte(line), &ev)
+				switch ev.Event {
+				case "entry":
+					entries++
+				case "done":
+					done = ev
+				}
+			}
+			wantFormat := map[string]string{"zip-dir": "zip", "tar-dir": "tar.gz"}[action]
+			if entries != 7 || done.Extra["format"] != wantFormat {
+				t.Fatalf("%d entry events, format %v", entries, done.Extra["format"])
+			}
+			totals := done.Extra["totals"].(map[string]interface{})
+			for k, want := range map[string]float64{"entries": 7, "files": 5, "dirs": 1, "size": 1050} {
+				if totals[k] != want {
+					t.Errorf("totals.%s = %v, want %v", k, totals[k], want)
+				}
+			}
+			if _, ok := totals["compressedSize"]; ok != (action == "zip-dir") {
+				t.Errorf("totals.compressedSize present=%v", ok)
+			}
+			var largest []string
+			for _, e := range done.Extra["largest"].([]interface{}) {
+				largest = append(largest, e.(map[string]interface{})["name"].(string))
+			}
+			if got := strings.Join(largest, " "); got != "sub/d.js a.js" {
+				t.Errorf("largest %q", got)
+			}
+			byExt := done.Extra["byExtension"].(map[string]interface{})
+			for ext, want := range map[string][2]float64{".js": {3, 800}, ".css": {1, 200}, "(none)": {1, 50}} {
+				s, _ := byExt[ext].(map[string]interface{})
+				if s == nil || s["count"] != want[0] || s["size"] != want[1] {
+					t.Errorf("byExtension[%s] = %v, want count %v size %v", ext, s, want[0], want[1])
+				}
+			}
+			if len(byExt) != 3 {
+				t.Errorf("byExtension has %d buckets", len(byExt))
+			}
+		})
+	}
+}
+
+func TestTreeDiff(t *testing.T) {
+	write := func(files map[string]string) string {
+		dir := t.TempDir()
+		for name, body := range files {
+			os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644)
+		}
+		return dir
+	}
+	before := write(map[string]string{
+		"a.txt":    "one",
+		"dup1.txt": "same",
+		"dup2.txt": "same",
+		"gone.txt": "bye",
+		"keep.txt": "keep",
+		"old.txt":  "moving content",
+	})
+	after := write(map[string]string{
+		"a.txt":      "one!!",
+		"dupnew.txt": "same",
+		"keep.txt":   "keep",
+		"moved.txt":  "moving content",
+		"new.txt":    "fresh!",
+	})
+	archive := func(action, src, prefix string) string {
+		dest := filepath.Join(t.TempDir(), "out")
+		req := runRequest{Src: src, Dest: dest, Prefix: prefix, TarGz: true}
+		if ok := map[string]func(runRequest, io.Writer) bool{"zip-dir": zipDir, "tar-dir": tarDir}[action](req, io.Discard); !ok {
+			t.Fatalf("%s failed", action)
+		}
+		return dest
+	}
+
+	// Of two removed files with the same content, the first in path order
+	// pairs with the added copy and the other stays removed.
+	want := []string{
+		"modified a.txt",
+		"removed dup2.txt",
+		"renamed dupnew.txt from dup1.txt",
+		"removed gone.txt",
+		"renamed moved.txt from old.txt",
+		"added new.txt",
+	}
+	for _, tc := range []struct {
+		name, base, src, prefix string
+	}{
+		{"dir to dir", before, after, ""},
+		{"zip to dir", archive("zip-dir", before, "site"), after, "site"},
+		{"dir to tar.gz", before, archive("tar-dir", after, ""), ""},
+		{"zip to tar.gz", archive("zip-dir", before, "site"), archive("tar-dir", after, "site"), "site"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if !treeDiff(runRequest{Base: tc.base, Src: tc.src, Prefix: tc.prefix}, &out) {
+				t.Fatalf("tree-diff failed: %s", out.String())
+			}
+			var got []string
+			var done ndjsonEvent
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				var ev ndjsonEvent
+				json.Unmarshal([]byte(line), &ev)
+				switch ev.Event {
+				case "diff":
+					d := fmt.Sprintf("%s %s", ev.Extra["change"], ev.Data)
+					if from, ok := ev.Extra["from"]; ok {
+						d += fmt.Sprintf(" from %s", from)
+					}
+					got = append(got, d)
+				case "done":
+					done = ev
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("diff events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+			for k, v := range map[string]interface{}{
+				"added": 1.0, "removed": 2.0, "modified": 1.0, "renamed": 2.0, "unchanged": 1.0, "changed": true,
+				"baseFiles": 6.0, "baseBytes": 32.0, "files": 5.0, "bytes": 33.0,
+				"bytesAdded": 6.0, "bytesRemoved": 7.0, "sizeDelta": 1.0,
+			} {
+				if done.Extra[k] != v {
+					t.Errorf("done.extra.%s = %v, want %v", k, done.Extra[k], v)
+				}
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	if !treeDiff(runRequest{Base: before, Src: archive("zip-dir", before, "")}, &out) || strings.Contains(out.String(), `"diff"`) {
+		t.Errorf("identical trees reported changes: %s", out.String())
+	}
+}
+
+func TestArchiveManifest(t *testing.T) {
+	src := t.TempDir()
+	writeGoldenTree(t, src, 0o644, time.Now())
+	manifestOf := func(t *testing.T, data []byte) map[string]manifestFile {
+		t.Helper()
+		var m deployManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("manifest: %v", err)
+		}
+		files := map[string]manifestFile{}
+		for _, f := range m.Files {
+			files[f.Path] = f
+		}
+		if m.Version != 1 || len(files) != 5 {
+			t.Fatalf("manifest version %d with %d files", m.Version, len(files))
+		}
+		return files
+	}
+	check := func(t *testing.T, files map[string]manifestFile) {
+		t.Helper()
+		body := "<h1>hello</h1>\n"
+		f := files["index.html"]
+		if f.Size != int64(len(body)) || f.Mode != "0644" || f.ContentType != "text/html; charset=utf-8" ||
+			f.SHA1 != fmt.Sprintf("%x", sha1.Sum([]byte(body))) || f.SHA256 != fmt.Sprintf("%x", sha256.Sum256([]byte(body))) {
+			t.Errorf("index.html: %+v", f)
+		}
+		if f := files["bin/run.sh"]; f.Mode != "0744" || f.ContentType != "text/plain; charset=utf-8" {
+			t.Errorf("bin/run.sh: %+v", f)
+		}
+	}
+
+	t.Run("embed", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "site.zip")
+		ev := finalEvent(t, zipDir, runRequest{Src: src, Dest: dest, Prefix: "site", Manifest: manifestEmbed})
+		if !*ev.OK || ev.Extra["manifest"] != "site/opd-manifest.json" || ev.Extra["manifestFiles"] != 5.0 {
+			t.Fatalf("zip-dir: %+v", ev)
+		}
+		zr, err := zip.OpenReader(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		last := zr.File[len(zr.File)-1]
+		if last.Name != "site/opd-manifest.json" {
+			t.Fatalf("last entry %s", last.Name)
+		}
+		data, _ := readZipEntry(last, 1<<20)
+		// Paths are relative to src, not to the prefix.
+		check(t, manifestOf(t, data))
+	})
+
+	t.Run("sidecar", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "site.tar.gz")
+		ev := finalEvent(t, tarDir, runRequest{Src: src, Dest: dest, TarGz: true, Manifest: manifestSidecar})
+		if !*ev.OK || ev.Extra["manifest"] != dest+".manifest.json" {
+			t.Fatalf("tar-dir: %+v", ev)
+		}
+		data, err := os.ReadFile(dest + ".manifest.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, manifestOf(t, data))
+	})
+
+	t.Run("sidecar fails", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "site.zip")
+		// A non-empty directory in the sidecar's place cannot be replaced.
+		os.MkdirAll(filepath.Join(dest+".manifest.json", "x"), 0o755)
+		if ev := finalEvent(t, zipDir, runRequest{Src: src, Dest: dest, Manifest: manifestSidecar}); *ev.OK {
+			t.Fatalf("zip-dir succeeded without its sidecar: %+v", ev)
+		}
+	})
+
+	t.Run("name collision", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, manifestEntryName), []byte("{}"), 0o644)
+		dest := filepath.Join(t.TempDir(), "site.zip")
+		ev := finalEvent(t, zipDir, runRequest{Src: dir, Dest: dest, Manifest: manifestEmbed})
+		if *ev.OK || ev.Reason != "invalid-args" {
+			t.Fatalf("embedding over %s: %+v", manifestEntryName, ev)
+		}
+		if _, err := os.Stat(dest); err == nil {
+			t.Error("archive written despite the collision")
+		}
+		// A sidecar does not collide with the file.
+		if ev := finalEvent(t, zipDir, runRequest{Src: dir, Dest: dest, Manifest: manifestSidecar}); !*ev.OK {
+			t.Errorf("sidecar: %+v", ev)
+		}
+	})
+}
+
+func TestZipPoolSize(t *testing.T) {
+	if n := zipWorkers(runRequest{Concurrency: 1000}); n != maxZipWorkers {
+		t.Errorf("concurrency 1000 gave %d workers", n)
+	}
+	src := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(src, name), []byte(name), 0o644)
+	}
+	os.Mkdir(filepath.Join(src, "dir"), 0o755)
+	scan, err := collectEntries(runRequest{Src: src}, &archiveFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, _ := newCompressionPolicy(runRequest{}, zipDeflateLevel)
+	for workers, want := range map[int]int{16: 3, 2: 2} {
+		p := startZipPool(scan.entries, workers, src, false, nil, policy)
+		p.stop()
+		if p.workers != want || cap(p.window) != 2*want {
+			t.Errorf("%d workers for 3 files: pool of %d", workers, p.workers)
+		}
+	}
+}
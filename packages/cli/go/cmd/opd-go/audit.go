@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// auditPaths returns the hash-chained action log for the project at cwd,
+// <cwd>/.opendeploy/audit.jsonl or $OPD_AUDIT_FILE, and the head file next
+// to it that pins the last record so truncation of the tail is detectable.
+func auditPaths(cwd string) (log, head string) {
+	log = os.Getenv("OPD_AUDIT_FILE")
+	if log == "" {
+		if cwd == "" {
+			cwd = "."
+		}
+		log = filepath.Join(cwd, ".opendeploy", "audit.jsonl")
+	}
+	return log, auditHeadFor(log)
+}
+
+// auditHeadFor names the head file of the log at path: audit.jsonl pairs
+// with audit.head.
+func auditHeadFor(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".head"
+}
+
+// auditRecord is one line of audit.jsonl. Prev is the sha256 of the previous
+// line's bytes (empty for the first record).
+type auditRecord struct {
+	Seq        int                    `json:"seq"`
+	Ts         string                 `json:"ts"`
+	Action     string                 `json:"action"`
+	Cmd        string                 `json:"cmd,omitempty"`
+	Args       map[string]interface{} `json:"args,omitempty"`
+	Cwd        string                 `json:"cwd,omitempty"`
+	GitSha     string                 `json:"gitSha,omitempty"`
+	DurationMs int64                  `json:"durationMs"`
+	OK         bool                   `json:"ok"`
+	ExitCode   int                    `json:"exitCode"`
+	Reason     string                 `json:"reason,omitempty"`
+	Artifacts  map[string]string      `json:"artifacts,omitempty"`
+	Prev       string                 `json:"prev"`
+}
+
+type auditHead struct {
+	Seq  int    `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+var (
+	secretFlagPattern   = regexp.MustCompile(`(?i)(--?(?:token|auth|password|passwd|secret|api-?key)(?:=|\s+))("[^"]*"|'[^']*'|\S+)`)
+	secretAssignPattern = regexp.MustCompile(`(?i)\b([A-Z0-9_]*(?:TOKEN|SECRET|PASSWORD|PASSWD|API_?KEY|AUTH)[A-Z0-9_]*=)("[^"]*"|'[^']*'|\S+)`)
+	urlCredsPattern     = regexp.MustCompile(`(://[^/\s:@]+:)[^@\s]+@`)
+)
+
+// redactCommand masks values of secret-looking flags, VAR=value assignments
+// and URL credentials in a command line.
+func redactCommand(cmd string) string {
+	cmd = secretFlagPattern.ReplaceAllString(cmd, "${1}***")
+	cmd = secretAssignPattern.ReplaceAllString(cmd, "${1}***")
+	return urlCredsPattern.ReplaceAllString(cmd, "${1}***@")
+}
+
+// appendAudit records a finished top-level action. Failures are reported on
+// stderr and never change the action's outcome.
+func appendAudit(req runRequest, relay *eventRelay, elapsed time.Duration) {
+	if os.Getenv("OPD_AUDIT_DISABLE") == "1" {
+		return
+	}
+	ok, code, reason, extra := relay.result()
+	cwd := req.Cwd
+	if cwd == "" {
+		cwd = "."
+	}
+	if abs, err := filepath.Abs(cwd); err == nil {
+		cwd = abs
+	}
+	rec := auditRecord{
+		Ts:         time.Now().UTC().Format(time.RFC3339Nano),
+		Action:     req.Action,
+		Cmd:        redactCommand(req.Cmd),
+		Args:       auditArgs(req),
+		Cwd:        cwd,
+		GitSha:     gitHead(cwd),
+		DurationMs: elapsed.Milliseconds(),
+		OK:         ok,
+		ExitCode:   code,
+		Reason:     reason,
+		Artifacts:  auditArtifacts(req, extra),
+	}
+	if err := writeAuditRecord(rec, cwd); err != nil {
+		fmt.Fprintln(os.Stderr, "opd-go: audit:", err)
+	}
+}
+
+// auditArgs keeps the non-secret request fields worth auditing. Env values
+// are never recorded, only their keys.
+func auditArgs(req runRequest) map[string]interface{} {
+	args := map[string]interface{}{}
+	for k, v := range map[string]string{"src": req.Src, "dest": req.Dest, "base": req.Base, "site": req.Site, "url": req.URL, "name": req.Name} {
+		if v != "" {
+			args[k] = redactCommand(v)
+		}
+	}
+	if req.Prod {
+		args["prod"] = true
+	}
+	if len(req.Env) > 0 {
+		keys := make([]string, 0, len(req.Env))
+		for k := range req.Env {
+			keys = append(keys, k)
+		}
+		args["envKeys"] = keys
+	}
+	if len(req.Steps) > 0 {
+		steps := make([]string, len(req.Steps))
+		for i, s := range req.Steps {
+			steps[i] = s.Action
+		}
+		args["steps"] = steps
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// auditArtifacts collects sha256 digests of files an action produced or
+// checked: done.extra.dest for packaging actions, digest for checksum-file.
+func auditArtifacts(req runRequest, extra map[string]interface{}) map[string]string {
+	out := map[string]string{}
+	if d, ok := extra["digest"].(string); ok && req.Src != "" {
+		out[req.Src] = d
+	}
+	if dest, ok := extra["dest"].(string); ok {
+		if sum, _, err := hashFile(dest); err == nil {
+			out[dest] = sum
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// gitHead returns the commit checked out in dir, or "" outside a repo.
+func gitHead(dir string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// writeAuditRecord appends rec to the log of the project at cwd under a lock
+// file, chaining it to the last line and updating the head pointer.
+func writeAuditRecord(rec auditRecord, cwd string) error {
+	path, headPath := auditPaths(cwd)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	last, seq, err := lastAuditLine(path)
+	if err != nil {
+		return err
+	}
+	rec.Seq = seq + 1
+	if last != nil {
+		rec.Prev = sha256Hex(last)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	head, _ := json.Marshal(auditHead{Seq: rec.Seq, Hash: sha256Hex(line)})
+	tmp := headPath + ".tmp"
+	if err := os.WriteFile(tmp, head, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, headPath)
+}
+
+// lastAuditLine returns the final line of the log and its sequence number.
+func lastAuditLine(path string) ([]byte, int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	b = bytes.TrimRight(b, "\n")
+	if len(b) == 0 {
+		return nil, 0, nil
+	}
+	line := b[bytes.LastIndexByte(b, '\n')+1:]
+	var rec auditRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return nil, 0, fmt.Errorf("audit log %s has a corrupt last line", path)
+	}
+	return line, rec.Seq, nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// lockFile takes an exclusive lock by creating path, breaking locks older
+// than ten seconds left behind by a crashed process.
+func lockFile(path string) (func(), error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if info, serr := os.Stat(path); serr == nil && time.Since(info.ModTime()) > 10*time.Second {
+			_ = os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// verifyAudit walks the audit log checking sequence numbers, the hash chain
+// and the head pointer, and reports the first inconsistency.
+func verifyAudit(req runRequest, stdout io.Writer) bool {
+	path, headPath := auditPaths(req.Cwd)
+	if req.Src != "" {
+		path, headPath = req.Src, auditHeadFor(req.Src)
+	}
+	fail := func(line int, reason, msg string, records int) bool {
+		ok := false
+		extra := map[string]interface{}{"path": path, "records": records}
+		if line > 0 {
+			extra["line"] = line
+		}
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: msg, Reason: reason})
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: reason, Extra: extra})
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fail(0, "not-found", err.Error(), 0)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	prevHash := ""
+	n := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return fail(n+1, "io-error", err.Error(), n)
+		}
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			return fail(n+1, "truncated", fmt.Sprintf("line %d is incomplete", n+1), n)
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		var rec auditRecord
+		if jerr := json.Unmarshal(line, &rec); jerr != nil {
+			return fail(n+1, "tampered", fmt.Sprintf("line %d is not a valid record", n+1), n)
+		}
+		if rec.Seq != n+1 {
+			return fail(n+1, "tampered", fmt.Sprintf("line %d has seq %d, want %d", n+1, rec.Seq, n+1), n)
+		}
+		if rec.Prev != prevHash {
+			return fail(n+1, "tampered", fmt.Sprintf("line %d does not chain to the previous record", n+1), n)
+		}
+		prevHash = sha256Hex(line)
+		n++
+	}
+	if b, err := os.ReadFile(headPath); err == nil {
+		var head auditHead
+		if json.Unmarshal(b, &head) == nil {
+			if head.Seq > n {
+				return fail(n, "truncated", fmt.Sprintf("log ends at record %d but head records %d", n, head.Seq), n)
+			}
+			if head.Seq == n && head.Hash != prevHash {
+				return fail(n, "tampered", fmt.Sprintf("last record %d does not match head", n), n)
+			}
+		}
+	} else if n > 0 {
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "audit head missing; tail truncation cannot be checked"})
+	}
+	ok := true
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(0), Final: boolPtr(true), Extra: map[string]interface{}{"path": path, "records": n, "head": prevHash}})
+	return true
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultCacheMaxBytes bounds the object store before LRU eviction kicks in.
+const defaultCacheMaxBytes = 1 << 30
+
+// cacheSpec is the run-stream cacheKey option. The key hashes the command,
+// the listed env values and the content of every file matching inputs;
+// outputs are the files or directories restored on a hit.
+type cacheSpec struct {
+	Inputs   []string `json:"inputs,omitempty"`
+	Env      []string `json:"env,omitempty"`
+	Outputs  []string `json:"outputs,omitempty"`
+	MaxBytes int64    `json:"maxBytes,omitempty"`
+}
+
+// cacheEntry is stored in .opendeploy/cache/entries/<key>.json.
+type cacheEntry struct {
+	Key       string         `json:"key"`
+	Cmd       string         `json:"cmd"`
+	CreatedAt string         `json:"createdAt"`
+	Lines     []cachedLine   `json:"lines"`
+	Outputs   []string       `json:"outputs"`
+	Files     []cachedObject `json:"files"`
+}
+
+type cachedLine struct {
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// cachedObject maps an output file (slash path relative to cwd) to its blob
+// in the content-addressed objects/ directory.
+type cachedObject struct {
+	Path   string      `json:"path"`
+	Mode   fs.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256"`
+}
+
+// runCache is the cache state for one run-stream request.
+type runCache struct {
+	root  string // project dir (request cwd)
+	dir   string // <root>/.opendeploy/cache
+	key   string
+	spec  cacheSpec
+	cmd   string
+	mu    sync.Mutex
+	lines []cachedLine
+}
+
+func openRunCache(req runRequest) (*runCache, error) {
+	root := req.Cwd
+	if root == "" {
+		root = "."
+	}
+	spec := *req.CacheKey
+	for _, o := range spec.Outputs {
+		if !filepath.IsLocal(filepath.FromSlash(o)) {
+			return nil, fmt.Errorf("cacheKey: output %q must be a relative path inside cwd", o)
+		}
+	}
+	files, err := expandGlobs(root, spec.Inputs)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "cmd\x00%s\x00", req.Cmd)
+	envKeys := append([]string{}, spec.Env...)
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		v, ok := req.Env[k]
+		if !ok {
+			v = os.Getenv(k)
+		}
+		fmt.Fprintf(h, "env\x00%s=%s\x00", k, v)
+	}
+	outs := append([]string{}, spec.Outputs...)
+	sort.Strings(outs)
+	for _, o := range outs {
+		fmt.Fprintf(h, "out\x00%s\x00", filepath.ToSlash(o))
+	}
+	for _, f := range files {
+		sum, _, err := hashFile(filepath.Join(root, filepath.FromSlash(f)))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(h, "in\x00%s\x00%s\x00", f, sum)
+	}
+	return &runCache{
+		root: root,
+		dir:  filepath.Join(root, ".opendeploy", "cache"),
+		key:  hex.EncodeToString(h.Sum(nil)),
+		spec: spec,
+		cmd:  req.Cmd,
+	}, nil
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func (c *runCache) entryPath(key string) string {
+	return filepath.Join(c.dir, "entries", key+".json")
+}
+
+func (c *runCache) objectPath(sum string) string {
+	return filepath.Join(c.dir, "objects", sum[:2], sum)
+}
+
+// lookup returns the stored entry for this key, if any.
+func (c *runCache) lookup() (*cacheEntry, bool) {
+	b, err := os.ReadFile(c.entryPath(c.key))
+	if err != nil {
+		return nil, false
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, false
+	}
+	return &e, true
+}
+
+// restore replaces the declared outputs with the cached files, then replays
+// the recorded output lines through emit. The entry's mtime is bumped so
+// eviction treats it as recently used.
+func (c *runCache) restore(e *cacheEntry, emit func(kind, line string)) error {
+	for _, f := range e.Files {
+		if _, err := os.Stat(c.objectPath(f.SHA256)); err != nil {
+			return fmt.Errorf("cache object missing for %s", f.Path)
+		}
+	}
+	for _, o := range e.Outputs {
+		if err := os.RemoveAll(filepath.Join(c.root, filepath.FromSlash(o))); err != nil {
+			return err
+		}
+	}
+	for _, f := range e.Files {
+		dst := filepath.Join(c.root, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		if err := copyFile(c.objectPath(f.SHA256), dst, f.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	_ = os.Chtimes(c.entryPath(e.Key), now, now)
+	for _, l := range e.Lines {
+		emit(l.Stream, l.Data)
+	}
+	return nil
+}
+
+// record is an output hook collecting lines for a later store.
+func (c *runCache) record(kind, line string) {
+	c.mu.Lock()
+	c.lines = append(c.lines, cachedLine{Stream: kind, Data: line})
+	c.mu.Unlock()
+}
+
+// reset drops the lines recorded so far, so only the final attempt of a
+// retried run is stored.
+func (c *runCache) reset() {
+	c.mu.Lock()
+	c.lines = nil
+	c.mu.Unlock()
+}
+
+// store saves the declared outputs into the object store and writes the
+// entry, then evicts least recently used entries beyond the size bound.
+// It returns the number of evicted entries.
+func (c *runCache) store() (int, error) {
+	e := cacheEntry{Key: c.key, Cmd: c.cmd, CreatedAt: time.Now().UTC().Format(time.RFC3339), Outputs: c.spec.Outputs, Files: []cachedObject{}}
+	c.mu.Lock()
+	e.Lines = append([]cachedLine{}, c.lines...)
+	c.mu.Unlock()
+	for _, o := range c.spec.Outputs {
+		base := filepath.Join(c.root, filepath.FromSlash(o))
+		err := filepath.WalkDir(base, func(full string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			sum, size, err := hashFile(full)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(c.objectPath(sum)); err != nil {
+				if err := os.MkdirAll(filepath.Dir(c.objectPath(sum)), 0o755); err != nil {
+					return err
+				}
+				if err := copyFile(full, c.objectPath(sum), 0o644); err != nil {
+					return err
+				}
+			}
+			rel, err := filepath.Rel(c.root, full)
+			if err != nil {
+				return err
+			}
+			e.Files = append(e.Files, cachedObject{Path: filepath.ToSlash(rel), Mode: info.Mode().Perm(), Size: size, SHA256: sum})
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, err
+		}
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.entryPath(c.key)), 0o755); err != nil {
+		return 0, err
+	}
+	tmp := c.entryPath(c.key) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, c.entryPath(c.key)); err != nil {
+		return 0, err
+	}
+	maxBytes := c.spec.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheMaxBytes
+	}
+	return c.evict(maxBytes)
+}
+
+// evict drops the least recently used entries (never the current one) until
+// the objects they reference fit in maxBytes, then deletes orphaned objects.
+func (c *runCache) evict(maxBytes int64) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "entries", "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	type loaded struct {
+		path  string
+		mtime time.Time
+		entry cacheEntry
+	}
+	var entries []loaded
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		var e cacheEntry
+		b, err := os.ReadFile(p)
+		if err != nil || json.Unmarshal(b, &e) != nil {
+			_ = os.Remove(p)
+			continue
+		}
+		entries = append(entries, loaded{path: p, mtime: info.ModTime(), entry: e})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mtime.Before(entries[j].mtime) })
+	referenced := func() (map[string]int64, int64) {
+		refs := map[string]int64{}
+		var total int64
+		for _, l := range entries {
+			for _, f := range l.entry.Files {
+				if _, ok := refs[f.SHA256]; !ok {
+					refs[f.SHA256] = f.Size
+					total += f.Size
+				}
+			}
+		}
+		return refs, total
+	}
+	evicted := 0
+	refs, total := referenced()
+	for total > maxBytes && len(entries) > 0 && entries[0].entry.Key != c.key {
+		_ = os.Remove(entries[0].path)
+		entries = entries[1:]
+		evicted++
+		refs, total = referenced()
+	}
+	err = filepath.WalkDir(filepath.Join(c.dir, "objects"), func(full string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			if _, ok := refs[d.Name()]; !ok {
+				_ = os.Remove(full)
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return evicted, err
+	}
+	return evicted, nil
+}
+
+// copyFile copies src to dst through a temp file so readers never observe a
+// partially written dst.
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// cacheSummary is the done.extra.cache payload.
+func (c *runCache) summary(status string, evicted int) map[string]interface{} {
+	out := map[string]interface{}{"status": status, "key": c.key}
+	if evicted > 0 {
+		out["evicted"] = evicted
+	}
+	return out
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// defaultCaptureMaxBytes caps a capture file before it is rotated.
+	defaultCaptureMaxBytes = 10 << 20
+	// captureKeep is how many rotated files (<name>.1 .. <name>.N) are kept.
+	captureKeep = 3
+)
+
+// captureLog appends the combined child output to a file with a stream
+// marker per line, rotating it once it grows past maxBytes.
+type captureLog struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	size     int64
+	maxBytes int64
+}
+
+// captureLogPath resolves a captureFile option to a file under
+// <cwd>/.opendeploy/logs. Absolute names and names escaping that directory
+// are rejected.
+func captureLogPath(cwd, name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("captureFile: %q is not a relative path inside .opendeploy/logs", name)
+	}
+	if cwd == "" {
+		cwd = "."
+	}
+	return filepath.Join(cwd, ".opendeploy", "logs", name), nil
+}
+
+func openCaptureLog(path string, maxBytes int64) (*captureLog, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultCaptureMaxBytes
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &captureLog{path: path, f: f, size: info.Size(), maxBytes: maxBytes}, nil
+}
+
+// writeLine records one line as "[<kind>] <line>". Write errors are dropped:
+// capture is best-effort and must never interrupt the child.
+func (c *captureLog) writeLine(kind, line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	rec := fmt.Sprintf("[%s] %s\n", kind, line)
+	if c.size > 0 && c.size+int64(len(rec)) > c.maxBytes {
+		c.rotate()
+		if c.f == nil {
+			return
+		}
+	}
+	n, _ := c.f.WriteString(rec)
+	c.size += int64(n)
+}
+
+// rotate shifts <path>.N-1 to <path>.N down to <path> to <path>.1 and starts
+// a fresh file. Callers hold c.mu.
+func (c *captureLog) rotate() {
+	_ = c.f.Close()
+	c.f = nil
+	for i := captureKeep; i > 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", c.path, i-1), fmt.Sprintf("%s.%d", c.path, i))
+	}
+	_ = os.Rename(c.path, c.path+".1")
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return
+	}
+	c.f = f
+	c.size = 0
+}
+
+func (c *captureLog) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+// tailBuffer keeps the last n lines of a stream.
+type tailBuffer struct {
+	mu    sync.Mutex
+	n     int
+	lines []string
+}
+
+func (t *tailBuffer) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.n {
+		t.lines = append(t.lines[:0], t.lines[len(t.lines)-t.n:]...)
+	}
+}
+
+func (t *tailBuffer) snapshot() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{}, t.lines...)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+)
+
+// defaultStoreExtensions are formats that are compressed already, so
+// deflating them again costs CPU for next to no gain.
+var defaultStoreExtensions = []string{
+	".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif",
+	".woff", ".woff2",
+	".mp4", ".webm", ".mov", ".mp3", ".m4a", ".ogg",
+	".zip", ".gz", ".tgz", ".br", ".zst", ".xz", ".bz2", ".7z",
+}
+
+// gzipDefaultLevel is the level gzip.DefaultCompression stands for, named so
+// done.extra can report it.
+const gzipDefaultLevel = 6
+
+// compressionPolicy decides how zip-dir compresses each file and at which
+// level zip-dir deflates and tar-dir gzips.
+type compressionPolicy struct {
+	level     int
+	store     map[string]bool // extensions stored as-is
+	threshold float64         // store when deflate saves less than this fraction
+}
+
+// newCompressionPolicy validates the compression options of req.
+// defaultLevel applies when compressionLevel is unset.
+func newCompressionPolicy(req runRequest, defaultLevel int) (*compressionPolicy, error) {
+	p := &compressionPolicy{level: defaultLevel, store: map[string]bool{}, threshold: req.StoreThreshold}
+	if req.CompressionLevel != 0 {
+		if req.CompressionLevel < flate.BestSpeed || req.CompressionLevel > flate.BestCompression {
+			return nil, fmt.Errorf("%s: compressionLevel must be between 1 and 9", req.Action)
+		}
+		p.level = req.CompressionLevel
+	}
+	if p.threshold < 0 || p.threshold >= 1 {
+		return nil, fmt.Errorf("%s: storeThreshold must be at least 0 and below 1", req.Action)
+	}
+	exts := req.StoreExtensions
+	if exts == nil {
+		exts = defaultStoreExtensions
+	}
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		p.store[ext] = true
+	}
+	return p, nil
+}
+
+// stores reports whether the file at archive name is stored without trying
+// to compress it.
+func (p *compressionPolicy) stores(name string) bool {
+	return p.store[strings.ToLower(path.Ext(name))]
+}
+
+// storesDeflated reports whether a file of size bytes that deflated to
+// compressed bytes is better stored.
+func (p *compressionPolicy) storesDeflated(size, compressed int64) bool {
+	return p.threshold > 0 && float64(size-compressed) < p.threshold*float64(size)
+}
+
+// compressionStats adds up file data before and after compression.
+type compressionStats struct {
+	size       int64
+	compressed int64
+	stored     int
+}
+
+// addTo reports the achieved ratio (compressed size over uncompressed size)
+// in done.extra.
+func (s compressionStats) addTo(extra map[string]interface{}, level int) {
+	extra["compressionLevel"] = level
+	extra["uncompressedSize"] = s.size
+	extra["compressedSize"] = s.compressed
+	if s.size > 0 {
+		extra["ratio"] = math.Round(float64(s.compressed)/float64(s.size)*1000) / 1000
+	}
+}
+
+// byteCounter counts the bytes written through it to w.
+type byteCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+)
+
+// extractorSpec is a named regex declared on a run-stream request. Several
+// specs may share a name; the last hit across all of them wins.
+type extractorSpec struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// extractorPresets are built-in extractors for provider CLI output, selected
+// with extractPresets. Names follow the url/logsUrl/deployId summary keys.
+var extractorPresets = map[string][]extractorSpec{
+	"vercel": {
+		{Name: "url", Pattern: `https?://[A-Za-z0-9.-]+\.vercel\.app`},
+		{Name: "logsUrl", Pattern: `https?://[^\s]*vercel\.com[^\s]*`},
+		{Name: "deployId", Pattern: `https?://vercel\.com/[^/\s]+/[^/\s]+/(?P<deployId>[A-Za-z0-9]+)`},
+		{Name: "deployId", Pattern: `\b(?P<deployId>dpl_[A-Za-z0-9]+)\b`},
+	},
+	"wrangler": {
+		{Name: "url", Pattern: `https?://[A-Za-z0-9.-]+\.(?:pages|workers)\.dev[^\s]*`},
+		{Name: "logsUrl", Pattern: `https?://dash\.cloudflare\.com/[^\s]+`},
+		{Name: "deployId", Pattern: `(?i)(?:deployment|version) id:\s*(?P<deployId>[0-9a-f-]{8,})`},
+	},
+	"netlify": {
+		{Name: "url", Pattern: `https?://[A-Za-z0-9.-]+\.netlify\.app[^\s]*`},
+		{Name: "logsUrl", Pattern: `https?://app\.netlify\.com/[^\s]+`},
+		{Name: "deployId", Pattern: `https?://app\.netlify\.com/sites/[^/\s]+/deploys/(?P<deployId>[0-9a-f]+)`},
+	},
+}
+
+type extractor struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// extractSet scans output lines with the compiled extractors, emitting a
+// match event per hit and remembering the last value for each name.
+type extractSet struct {
+	mu   sync.Mutex
+	list []extractor
+	last map[string]string
+}
+
+func compileExtractors(specs []extractorSpec, presets []string) (*extractSet, error) {
+	if len(specs) == 0 && len(presets) == 0 {
+		return nil, nil
+	}
+	var all []extractorSpec
+	for _, p := range presets {
+		ps, ok := extractorPresets[p]
+		if !ok {
+			return nil, fmt.Errorf("extract: unknown preset %q", p)
+		}
+		all = append(all, ps...)
+	}
+	all = append(all, specs...)
+	x := &extractSet{last: map[string]string{}}
+	for _, s := range all {
+		if s.Name == "" {
+			return nil, fmt.Errorf("extract: name required for pattern %q", s.Pattern)
+		}
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("extract: invalid pattern for %q: %v", s.Name, err)
+		}
+		x.list = append(x.list, extractor{name: s.Name, re: re})
+	}
+	return x, nil
+}
+
+// scan checks one output line. The extracted value is the capture group named
+// after the extractor, else the first group, else the whole match.
+func (x *extractSet) scan(kind, line string, stdout io.Writer) {
+	for _, e := range x.list {
+		for _, m := range e.re.FindAllStringSubmatch(line, -1) {
+			value := m[0]
+			groups := map[string]interface{}{}
+			for i, g := range e.re.SubexpNames() {
+				if g != "" {
+					groups[g] = m[i]
+				}
+			}
+			if v, ok := groups[e.name].(string); ok {
+				value = v
+			} else if len(m) > 1 {
+				value = m[1]
+			}
+			x.mu.Lock()
+			x.last[e.name] = value
+			x.mu.Unlock()
+			extra := map[string]interface{}{"name": e.name, "value": value, "stream": kind}
+			if len(groups) > 0 {
+				extra["groups"] = groups
+			}
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "match", Data: value, Extra: extra})
+		}
+	}
+}
+
+// values returns the last value seen for each extractor name.
+func (x *extractSet) values() map[string]interface{} {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	out := make(map[string]interface{}, len(x.last))
+	for k, v := range x.last {
+		out[k] = v
+	}
+	return out
+}
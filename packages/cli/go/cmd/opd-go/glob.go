@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// matchGlob reports whether the slash-separated name matches pattern.
+// Within a segment *, ? and [...] behave as in path.Match; a "**" segment
+// matches zero or more whole segments.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pat, parts []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for len(pat) > 0 && pat[0] == "**" {
+				pat = pat[1:]
+			}
+			if len(pat) == 0 {
+				return true
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(pat, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pat[0], parts[0]); err != nil || !ok {
+			return false
+		}
+		pat, parts = pat[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// globBase returns the leading segments of pattern that contain no glob
+// metacharacters, so a walk can start there instead of at the root.
+func globBase(pattern string) string {
+	segs := strings.Split(pattern, "/")
+	i := 0
+	for ; i < len(segs)-1; i++ {
+		if strings.ContainsAny(segs[i], "*?[") {
+			break
+		}
+	}
+	return strings.Join(segs[:i], "/")
+}
+
+// expandGlobs returns the sorted, de-duplicated slash paths of regular files
+// under root matching any pattern. A pattern naming a directory matches every
+// file below it. .git and .opendeploy are never descended into.
+func expandGlobs(root string, patterns []string) ([]string, error) {
+	seen := map[string]bool{}
+	for _, p := range patterns {
+		p = strings.TrimPrefix(path.Clean(filepath.ToSlash(p)), "./")
+		if info, err := os.Stat(filepath.Join(root, filepath.FromSlash(p))); err == nil && info.IsDir() {
+			p += "/**"
+		}
+		if !strings.ContainsAny(p, "*?[") {
+			if info, err := os.Stat(filepath.Join(root, filepath.FromSlash(p))); err == nil && info.Mode().IsRegular() {
+				seen[p] = true
+			}
+			continue
+		}
+		base := globBase(p)
+		start := filepath.Join(root, filepath.FromSlash(base))
+		if _, err := os.Stat(start); err != nil {
+			continue
+		}
+		err := filepath.WalkDir(start, func(full string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, rerr := filepath.Rel(root, full)
+			if rerr != nil {
+				return rerr
+			}
+			rel = filepath.ToSlash(rel)
+			if d.IsDir() {
+				if d.Name() == ".git" || d.Name() == ".opendeploy" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() && matchGlob(p, rel) {
+				seen[rel] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for k := range seen {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out, nil
+}
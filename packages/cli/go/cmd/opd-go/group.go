@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// lockedWriter serialises writes from concurrently running commands so their
+// NDJSON lines never interleave.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// runGroup starts req.Commands concurrently, at most req.Concurrency at a
+// time. With req.FailFast the first failure cancels running commands and
+// skips those not yet started; otherwise every command runs to completion.
+func runGroup(req runRequest, stdout io.Writer) bool {
+	if len(req.Commands) == 0 {
+		ok := false
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: "run-group: commands required"})
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+		return false
+	}
+	cmds := make([]runRequest, len(req.Commands))
+	for i, c := range req.Commands {
+		cmds[i] = inheritRunDefaults(req, c)
+		if cmds[i].Name == "" {
+			cmds[i].Name = fmt.Sprintf("cmd%d", i+1)
+		}
+	}
+	results, ok := runCommands(cmds, req.Concurrency, req.FailFast, stdout)
+	return finishGroup(results, ok, map[string]interface{}{}, stdout)
+}
+
+// finishGroup writes the aggregate done event shared by run-group and
+// matrix-run, adding the per-command results to extra.
+func finishGroup(results []map[string]interface{}, ok bool, extra map[string]interface{}, stdout io.Writer) bool {
+	passed, failed, skipped := 0, 0, 0
+	// Report the first genuine failure, not a command cancelled by fail-fast.
+	exitCode, cancelledCode := 0, 0
+	for _, r := range results {
+		switch {
+		case r["skipped"] == true:
+			skipped++
+		case r["ok"] == true:
+			passed++
+		default:
+			failed++
+			code, _ := r["exitCode"].(int)
+			if code == 0 {
+				code = 1
+			}
+			if r["reason"] == "cancelled" {
+				if cancelledCode == 0 {
+					cancelledCode = code
+				}
+			} else if exitCode == 0 {
+				exitCode = code
+			}
+		}
+	}
+	if exitCode == 0 {
+		exitCode = cancelledCode
+	}
+	if exitCode == 0 && !ok {
+		exitCode = 1
+	}
+	extra["results"] = results
+	extra["passed"] = passed
+	extra["failed"] = failed
+	extra["skipped"] = skipped
+	reason := ""
+	if !ok {
+		reason = "command-failed"
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: &exitCode, Final: boolPtr(true), Reason: reason, Extra: extra})
+	return ok
+}
+
+// runCommands runs cmds as run-stream requests with bounded parallelism.
+// Events from each command are tagged with its Name and its done event is
+// forwarded as "step-done". Results are returned in input order.
+func runCommands(cmds []runRequest, concurrency int, failFast bool, stdout io.Writer) ([]map[string]interface{}, bool) {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	out := &lockedWriter{w: stdout}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make([]map[string]interface{}, len(cmds))
+	var mu sync.Mutex
+	allOK := true
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, c := range cmds {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			results[i] = map[string]interface{}{"name": c.Name, "ok": false, "skipped": true}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, c runRequest) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			name := c.Name
+			writeEvent(out, ndjsonEvent{Action: "go", Event: "status", Name: name, Data: "starting"})
+			relay := &eventRelay{out: out, hook: func(ev *ndjsonEvent) bool {
+				ev.Name = name
+				if ev.Event == "done" {
+					ev.Event = "step-done"
+					ev.Final = nil
+				}
+				return true
+			}}
+			start := time.Now()
+			runStreamContext(ctx, c, relay)
+			ok, code, reason, extra := relay.result()
+			res := map[string]interface{}{"name": name, "ok": ok, "exitCode": code, "durationMs": time.Since(start).Milliseconds()}
+			if reason != "" {
+				res["reason"] = reason
+			}
+			if extra != nil {
+				res["extra"] = extra
+			}
+			mu.Lock()
+			results[i] = res
+			if !ok {
+				allOK = false
+				if failFast {
+					cancel()
+				}
+			}
+			mu.Unlock()
+		}(i, c)
+	}
+	wg.Wait()
+	for _, r := range results {
+		if r["skipped"] == true {
+			allOK = false
+		}
+	}
+	return results, allOK
+}
+
+// inheritRunDefaults fills the run-stream fields a group command leaves unset
+// from the enclosing group request. Env maps are merged, command wins.
+func inheritRunDefaults(parent, c runRequest) runRequest {
+	c.Action = "run-stream"
+	if c.Cwd == "" {
+		c.Cwd = parent.Cwd
+	}
+	if c.TimeoutSec == 0 {
+		c.TimeoutSec = parent.TimeoutSec
+	}
+	if c.IdleTimeoutSec == 0 {
+		c.IdleTimeoutSec = parent.IdleTimeoutSec
+	}
+	if c.Sandbox == nil {
+		c.Sandbox = parent.Sandbox
+	}
+	if len(parent.Env) > 0 {
+		env := map[string]string{}
+		for k, v := range parent.Env {
+			env[k] = v
+		}
+		for k, v := range c.Env {
+			env[k] = v
+		}
+		c.Env = env
+	}
+	return c
+}
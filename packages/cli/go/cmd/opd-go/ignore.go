@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// opdIgnoreFile is read from the root of an archived directory.
+const opdIgnoreFile = ".opdignore"
+
+// ignoreRule is one include, exclude or .opdignore pattern in gitignore
+// form, compiled to a matchGlob pattern relative to the archive root.
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnoreRule compiles a gitignore-style pattern. A leading "!" negates
+// it and a trailing "/" limits it to directories. A pattern without any
+// other "/" matches at any depth; otherwise it is anchored at the root.
+func parseIgnoreRule(line string) (ignoreRule, error) {
+	var r ignoreRule
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return r, errors.New("empty pattern")
+	}
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+	for _, seg := range strings.Split(line, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return r, fmt.Errorf("invalid pattern %q", line)
+		}
+	}
+	r.pattern = line
+	return r, nil
+}
+
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	return (!r.dirOnly || isDir) && matchGlob(r.pattern, rel)
+}
+
+// archiveFilter decides which entries below src end up in an archive.
+type archiveFilter struct {
+	include []ignoreRule
+	exclude []ignoreRule
+	ignore  []ignoreRule
+}
+
+// loadArchiveFilter compiles req.Include, req.Exclude and src/.opdignore.
+func loadArchiveFilter(req runRequest) (*archiveFilter, error) {
+	f := &archiveFilter{}
+	for _, list := range []struct {
+		name     string
+		patterns []string
+		rules    *[]ignoreRule
+	}{{"include", req.Include, &f.include}, {"exclude", req.Exclude, &f.exclude}} {
+		for _, p := range list.patterns {
+			r, err := parseIgnoreRule(p)
+			if err == nil && r.negate {
+				err = errors.New("negation is only supported in " + opdIgnoreFile)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s %q: %v", list.name, p, err)
+			}
+			*list.rules = append(*list.rules, r)
+		}
+	}
+	file, err := os.Open(filepath.Join(req.Src, opdIgnoreFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		// Trailing spaces are dropped unless escaped with a backslash.
+		if trimmed := strings.TrimRight(line, " "); !strings.HasSuffix(trimmed, `\`) {
+			line = trimmed
+		} else if len(trimmed) < len(line) {
+			line = trimmed[:len(trimmed)-1] + " "
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseIgnoreRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", opdIgnoreFile, n, err)
+		}
+		f.ignore = append(f.ignore, r)
+	}
+	return f, s.Err()
+}
+
+// skip reports whether the entry at rel (slash path relative to src) is left
+// out. Excludes always win; among .opdignore rules the last match decides.
+// Includes only restrict files, so directories are still descended into;
+// inherited is set below a directory an include matched, which brings in
+// everything under it.
+func (f *archiveFilter) skip(rel string, isDir, inherited bool) bool {
+	if rel == opdIgnoreFile {
+		return true
+	}
+	for _, r := range f.exclude {
+		if r.matches(rel, isDir) {
+			return true
+		}
+	}
+	ignored := false
+	for _, r := range f.ignore {
+		if r.matches(rel, isDir) {
+			ignored = !r.negate
+		}
+	}
+	if ignored {
+		return true
+	}
+	if isDir || inherited || len(f.include) == 0 {
+		return false
+	}
+	return !f.included(rel, false)
+}
+
+// included reports whether an include rule matches the entry at rel.
+func (f *archiveFilter) included(rel string, isDir bool) bool {
+	for _, r := range f.include {
+		if r.matches(rel, isDir) {
+			return true
+		}
+	}
+	return false
+}
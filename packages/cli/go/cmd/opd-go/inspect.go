@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultListTop is how many of the largest entries archive-list reports.
+const defaultListTop = 10
+
+// listedEntry is one archive member as reported by archive-list.
+type listedEntry struct {
+	name       string
+	kind       string
+	size       int64
+	compressed int64 // -1 when the format has no per-entry compressed size
+	mode       fs.FileMode
+	mtime      time.Time
+	link       string
+}
+
+func (e listedEntry) extra() map[string]interface{} {
+	out := map[string]interface{}{"name": e.name, "type": e.kind, "size": e.size, "mode": e.mode.String()}
+	if e.compressed >= 0 {
+		out["compressedSize"] = e.compressed
+	}
+	if !e.mtime.IsZero() {
+		out["mtime"] = e.mtime.UTC().Format(time.RFC3339)
+	}
+	if e.link != "" {
+		out["linkname"] = e.link
+	}
+	return out
+}
+
+// archiveFormat sniffs path: "zip", "tar.gz" or "tar".
+func archiveFormat(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(f, magic)
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return "zip", nil
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return "tar.gz", nil
+	}
+	return "tar", nil
+}
+
+// listArchive streams one "entry" event per member of the zip or tar(.gz)
+// at req.Src, then a summary with totals, the req.Top largest files and a
+// per-extension breakdown.
+func listArchive(req runRequest, stdout io.Writer) bool {
+	if req.Src == "" {
+		return archiveFail(stdout, "archive-list: src required", "invalid-args")
+	}
+	format, err := archiveFormat(req.Src)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "")
+	}
+	var files []listedEntry
+	type extStats struct {
+		Count          int   `json:"count"`
+		Size           int64 `json:"size"`
+		CompressedSize int64 `json:"compressedSize,omitempty"`
+	}
+	byExt := map[string]*extStats{}
+	totals := map[string]int64{"entries": 0, "files": 0, "dirs": 0, "size": 0}
+	var compressedTotal int64
+	emit := func(e listedEntry) {
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "entry", Data: e.name, Extra: e.extra()})
+		totals["entries"]++
+		switch e.kind {
+		case "dir":
+			totals["dirs"]++
+		case "file":
+			totals["files"]++
+		}
+		// Sizes, largest and byExtension describe file content only; a
+		// link's size is its target name and hardlinks repeat a file.
+		if e.kind != "file" {
+			return
+		}
+		totals["size"] += e.size
+		if e.compressed > 0 {
+			compressedTotal += e.compressed
+		}
+		files = append(files, e)
+		ext := strings.ToLower(path.Ext(e.name))
+		if ext == "" {
+			ext = "(none)"
+		}
+		s := byExt[ext]
+		if s == nil {
+			s = &extStats{}
+			byExt[ext] = s
+		}
+		s.Count++
+		s.Size += e.size
+		if e.compressed > 0 {
+			s.CompressedSize += e.compressed
+		}
+	}
+	if format == "zip" {
+		err = listZip(req.Src, emit)
+	} else {
+		err = listTar(req.Src, format == "tar.gz", emit)
+	}
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "invalid-archive")
+	}
+
+	top := req.Top
+	if top <= 0 {
+		top = defaultListTop
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].size > files[j].size })
+	if len(files) > top {
+		files = files[:top]
+	}
+	largest := make([]interface{}, len(files))
+	for i, e := range files {
+		largest[i] = e.extra()
+	}
+	if info, err := os.Stat(req.Src); err == nil {
+		totals["archiveSize"] = info.Size()
+	}
+	if format == "zip" {
+		totals["compressedSize"] = compressedTotal
+	}
+	ok := true
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(0), Final: boolPtr(true), Extra: map[string]interface{}{"format": format, "totals": totals, "largest": largest, "byExtension": byExt}})
+	return true
+}
+
+func listZip(src string, emit func(listedEntry)) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		mode := f.Mode()
+		e := listedEntry{name: f.Name, kind: "file", size: int64(f.UncompressedSize64), compressed: int64(f.CompressedSize64), mode: mode, mtime: f.Modified}
+		switch {
+		case mode.IsDir() || strings.HasSuffix(f.Name, "/"):
+			e.kind = "dir"
+		case mode&fs.ModeSymlink != 0:
+			e.kind = "symlink"
+			if target, err := readZipEntry(f, 4096); err == nil {
+				e.link = string(target)
+			}
+		case !mode.IsRegular():
+			e.kind = "other"
+		}
+		emit(e)
+	}
+	return nil
+}
+
+func listTar(src string, gz bool, emit func(listedEntry)) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if gz {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := listedEntry{name: hdr.Name, kind: "other", size: hdr.Size, compressed: -1, mode: hdr.FileInfo().Mode(), mtime: hdr.ModTime, link: hdr.Linkname}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			e.kind = "file"
+		case tar.TypeDir:
+			e.kind = "dir"
+		case tar.TypeSymlink:
+			e.kind = "symlink"
+		case tar.TypeLink:
+			e.kind = "hardlink"
+		case tar.TypeXGlobalHeader:
+			continue
+		}
+		emit(e)
+	}
+}
@@ -11,11 +11,10 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"path/filepath"
-	"archive/zip"
-	"archive/tar"
-	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
 	"crypto/sha1"
@@ -38,6 +37,22 @@ type runRequest struct {
 	Algo            string            `json:"algo,omitempty"`
 	TarGz           bool              `json:"targz,omitempty"`
 	Prefix          string            `json:"prefix,omitempty"`
+	Reproducible    bool              `json:"reproducible,omitempty"`
+	Include         []string          `json:"include,omitempty"`
+	Exclude         []string          `json:"exclude,omitempty"`
+	Symlinks        string            `json:"symlinks,omitempty"`
+	Manifest        string            `json:"manifest,omitempty"`
+	// Compression policy (zip-dir; compressionLevel also for tar-dir targz)
+	CompressionLevel int              `json:"compressionLevel,omitempty"`
+	StoreExtensions []string          `json:"storeExtensions,omitempty"`
+	StoreThreshold  float64           `json:"storeThreshold,omitempty"`
+	// Extraction limits (unzip, untar)
+	MaxBytes        int64             `json:"maxBytes,omitempty"`
+	MaxEntries      int               `json:"maxEntries,omitempty"`
+	// archive-list
+	Top             int               `json:"top,omitempty"`
+	// tree-diff: the previous build, compared against src
+	Base            string            `json:"base,omitempty"`
 	// PTY
 	Pty             bool              `json:"pty,omitempty"`
 	Cols            int               `json:"cols,omitempty"`
@@ -45,6 +60,42 @@ type runRequest struct {
 	// Netlify direct deploy
 	Site            string            `json:"site,omitempty"`
 	Prod            bool              `json:"prod,omitempty"`
+	// Pipeline
+	Name            string            `json:"name,omitempty"`
+	Steps           []runRequest      `json:"steps,omitempty"`
+	// Run group
+	Commands        []runRequest      `json:"commands,omitempty"`
+	Concurrency     int               `json:"concurrency,omitempty"`
+	FailFast        bool              `json:"failFast,omitempty"`
+	// Matrix
+	Axes            map[string][]string `json:"axes,omitempty"`
+	// Retry policy for run-stream
+	Retry           *retryPolicy      `json:"retry,omitempty"`
+	// Output extractors for run-stream
+	Extract         []extractorSpec   `json:"extract,omitempty"`
+	ExtractPresets  []string          `json:"extractPresets,omitempty"`
+	// Decode JSON-object stdout lines into json events
+	ParseJSON       bool              `json:"parseJson,omitempty"`
+	// Output capture for run-stream
+	CaptureFile     string            `json:"captureFile,omitempty"`
+	CaptureMaxBytes int64             `json:"captureMaxBytes,omitempty"`
+	TailLines       int               `json:"tailLines,omitempty"`
+	// Session recording (run-stream) and replay
+	Record          string            `json:"record,omitempty"`
+	Instant         bool              `json:"instant,omitempty"`
+	// Input-hash caching for run-stream
+	CacheKey        *cacheSpec        `json:"cacheKey,omitempty"`
+	// Readiness probes (wait-http, wait-port)
+	URL             string            `json:"url,omitempty"`
+	ExpectStatus    int               `json:"expectStatus,omitempty"`
+	BodyRegex       string            `json:"bodyRegex,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	ExpectHeaders   map[string]string `json:"expectHeaders,omitempty"`
+	Host            string            `json:"host,omitempty"`
+	Port            int               `json:"port,omitempty"`
+	IntervalMs      int               `json:"intervalMs,omitempty"`
+	// Namespace sandbox for run-stream (Linux)
+	Sandbox         *sandboxSpec      `json:"sandbox,omitempty"`
 }
 
 // runStreamPTY is provided by pty_run.go (with build tag) or falls back to non-PTY in pty_stub.go.
@@ -59,12 +110,14 @@ type ndjsonEvent struct {
 	Error  string                 `json:"error,omitempty"`
 	Extra  map[string]interface{} `json:"extra,omitempty"`
 	Reason string                 `json:"reason,omitempty"`
+	// Name tags events produced on behalf of a pipeline step or group command.
+	Name   string                 `json:"name,omitempty"`
 }
 
 func writeEvent(w io.Writer, ev ndjsonEvent) {
 	enc, _ := json.Marshal(ev)
-	_, _ = w.Write(enc)
-	_, _ = w.Write([]byte("\n"))
+	// A single write keeps lines intact when several goroutines share w.
+	_, _ = w.Write(append(enc, '\n'))
 }
 
 func shellCommand(cmdline string) *exec.Cmd {
@@ -78,7 +131,190 @@ func shellCommand(cmdline string) *exec.Cmd {
 }
 
 func runStream(req runRequest, stdout io.Writer) int {
-	ctx := context.Background()
+	return runStreamContext(context.Background(), req, stdout)
+}
+
+// runStreamContext is runStream with a parent context; cancelling ctx kills
+// the process tree and reports reason "cancelled". With req.Retry set, failed
+// attempts are re-run according to the policy before the final done event.
+func runStreamContext(ctx context.Context, req runRequest, stdout io.Writer) int {
+	if perr := enforcePolicy("run-stream", req); perr != nil {
+		ok := false
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: perr.Error(), Reason: "policy-denied"})
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "policy-denied"})
+		return 1
+	}
+	policy, err := compileRetryPolicy(req.Retry)
+	var extractors *extractSet
+	if err == nil {
+		extractors, err = compileExtractors(req.Extract, req.ExtractPresets)
+	}
+	if err != nil {
+		ok := false
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error()})
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+		return 1
+	}
+	var hooks []func(kind, line string)
+	var matched atomic.Bool
+	if len(policy.onOutput) > 0 {
+		hooks = append(hooks, func(kind, line string) {
+			if !matched.Load() && policy.matchesOutput(line) {
+				matched.Store(true)
+			}
+		})
+	}
+	if extractors != nil {
+		hooks = append(hooks, func(kind, line string) { extractors.scan(kind, line, stdout) })
+	}
+	var capture *captureLog
+	if req.CaptureFile != "" {
+		path, perr := captureLogPath(req.Cwd, req.CaptureFile)
+		if perr == nil {
+			capture, perr = openCaptureLog(path, req.CaptureMaxBytes)
+		}
+		if perr != nil {
+			ok := false
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: perr.Error()})
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "capture-failed"})
+			return 1
+		}
+		defer capture.Close()
+		hooks = append(hooks, capture.writeLine)
+	}
+	var recorder *castRecorder
+	if req.Record != "" {
+		var rerr error
+		recorder, rerr = openCastRecorder(req.Cwd, req.Record, req)
+		if rerr != nil {
+			ok := false
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: rerr.Error()})
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "record-failed"})
+			return 1
+		}
+		hooks = append(hooks, recorder.writeLine)
+	}
+	var tails map[string]*tailBuffer
+	if req.TailLines > 0 {
+		tails = map[string]*tailBuffer{"stdout": {n: req.TailLines}, "stderr": {n: req.TailLines}}
+		hooks = append(hooks, func(kind, line string) { tails[kind].add(line) })
+	}
+	var onLine func(kind, line string)
+	if len(hooks) > 0 || req.CacheKey != nil {
+		onLine = func(kind, line string) {
+			for _, h := range hooks {
+				h(kind, line)
+			}
+		}
+	}
+	var cache *runCache
+	cacheStatus := ""
+	if req.CacheKey != nil {
+		cache, err = openRunCache(req)
+		if err != nil {
+			ok := false
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error()})
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+			return 1
+		}
+		cacheStatus = "miss"
+		if entry, hit := cache.lookup(); hit {
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "cache hit", Extra: map[string]interface{}{"key": cache.key}})
+			rerr := cache.restore(entry, func(kind, line string) {
+				writeEvent(stdout, lineEvent(req, kind, line))
+				onLine(kind, line)
+			})
+			if rerr == nil {
+				cacheStatus = "hit"
+			} else {
+				writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "cache restore failed, running: " + rerr.Error()})
+			}
+		} else {
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "cache miss", Extra: map[string]interface{}{"key": cache.key}})
+		}
+		if cacheStatus == "miss" {
+			hooks = append(hooks, cache.record)
+		}
+	}
+	var res attemptResult
+	attempt := 1
+	for ; cacheStatus != "hit"; attempt++ {
+		if policy.maxAttempts > 1 {
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "attempt", Extra: map[string]interface{}{"attempt": attempt, "maxAttempts": policy.maxAttempts}})
+		}
+		matched.Store(false)
+		if cacheStatus == "miss" {
+			cache.reset()
+		}
+		if capture != nil {
+			capture.writeLine("opd", fmt.Sprintf("attempt %d: %s", attempt, req.Cmd))
+		}
+		res = runAttempt(ctx, req, stdout, onLine)
+		if capture != nil {
+			capture.writeLine("opd", strings.TrimSpace(fmt.Sprintf("exit %d %s", res.exitCode, res.reason)))
+		}
+		if res.ok || attempt >= policy.maxAttempts || ctx.Err() != nil || !policy.shouldRetry(res, matched.Load()) {
+			break
+		}
+		delay := policy.backoff(attempt)
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: fmt.Sprintf("retrying in %s", delay.Round(time.Millisecond)), Extra: map[string]interface{}{"attempt": attempt, "exitCode": res.exitCode, "delayMs": delay.Milliseconds()}})
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+	extra := map[string]interface{}{}
+	if cacheStatus == "hit" {
+		res = attemptResult{ok: true}
+		extra["cache"] = cache.summary("hit", 0)
+	} else if cache != nil {
+		evicted := 0
+		if res.ok {
+			var serr error
+			if evicted, serr = cache.store(); serr != nil {
+				writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "cache store failed: " + serr.Error()})
+			}
+		}
+		extra["cache"] = cache.summary("miss", evicted)
+	}
+	if req.Retry != nil && cacheStatus != "hit" {
+		extra["attempts"] = attempt
+	}
+	if extractors != nil {
+		extra["matches"] = extractors.values()
+	}
+	if capture != nil {
+		extra["captureFile"] = capture.path
+	}
+	if recorder != nil {
+		if rerr := recorder.finish(res.exitCode, res.reason); rerr != nil {
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: rerr.Error(), Reason: "record-failed"})
+		}
+		extra["recording"] = recorder.path
+	}
+	if tails != nil {
+		extra["tail"] = map[string]interface{}{"stdout": tails["stdout"].snapshot(), "stderr": tails["stderr"].snapshot()}
+	}
+	if len(extra) == 0 {
+		extra = nil
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &res.ok, Exit: &res.exitCode, Final: boolPtr(true), Reason: res.reason, Extra: extra})
+	if res.reason == "start-failed" {
+		return 1
+	}
+	return 0
+}
+
+// attemptResult is the outcome of a single run of the child process.
+type attemptResult struct {
+	ok       bool
+	exitCode int
+	reason   string
+}
+
+// runAttempt starts the command once and streams its output, calling onLine
+// (when set) for every emitted stdout/stderr line. It does not write done.
+func runAttempt(ctx context.Context, req runRequest, stdout io.Writer, onLine func(kind, line string)) attemptResult {
 	if req.TimeoutSec > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.TimeoutSec)*time.Second)
@@ -98,16 +334,33 @@ func runStream(req runRequest, stdout io.Writer) int {
 	}
 	// Ensure subprocesses share a process group on platforms that support it.
 	setProcessGroup(cmd)
+	var sandboxReady func(error) error
+	if req.Sandbox != nil {
+		ready, err := sandboxCommand(cmd, req)
+		if err != nil {
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error(), Reason: "E_UNSUPPORTED"})
+			return attemptResult{ok: false, exitCode: 1, reason: "E_UNSUPPORTED"}
+		}
+		sandboxReady = ready
+	}
 	// Attach pipes
 	stderrPipe, _ := cmd.StderrPipe()
 	stdoutPipe, _ := cmd.StdoutPipe()
 
 	// Start
-	if err := cmd.Start(); err != nil {
-		ok := false
+	err := cmd.Start()
+	if sandboxReady != nil {
+		if serr := sandboxReady(err); serr != nil {
+			if err == nil {
+				_ = cmd.Wait()
+			}
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: serr.Error(), Reason: "E_UNSUPPORTED"})
+			return attemptResult{ok: false, exitCode: 1, reason: "E_UNSUPPORTED"}
+		}
+	}
+	if err != nil {
 		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error(), Reason: "start-failed"})
-		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "start-failed"})
-		return 1
+		return attemptResult{ok: false, exitCode: 1, reason: "start-failed"}
 	}
 
 	lastActivity := time.Now()
@@ -115,10 +368,20 @@ func runStream(req runRequest, stdout io.Writer) int {
 
 	heartbeatInterval := 5 * time.Second
 	heartbeatTicker := time.NewTicker(heartbeatInterval)
-	defer heartbeatTicker.Stop()
+	heartbeatDone := make(chan struct{})
+	defer func() {
+		heartbeatTicker.Stop()
+		// Stop does not close C, so the goroutine needs its own signal.
+		close(heartbeatDone)
+	}()
 
 	go func() {
-		for range heartbeatTicker.C {
+		for {
+			select {
+			case <-heartbeatDone:
+				return
+			case <-heartbeatTicker.C:
+			}
 			emit(ndjsonEvent{
 				Action: "go",
 				Event: "status",
@@ -134,7 +397,10 @@ func runStream(req runRequest, stdout io.Writer) int {
 		for s.Scan() {
 			line := strings.TrimRight(s.Text(), "\r\n")
 			if line != "" {
-				emit(ndjsonEvent{Action: "go", Event: kind, Data: line})
+				emit(lineEvent(req, kind, line))
+				if onLine != nil {
+					onLine(kind, line)
+				}
 			}
 		}
 	}
@@ -142,12 +408,14 @@ func runStream(req runRequest, stdout io.Writer) int {
 	// Idle timeout watchdog
 	idle := req.IdleTimeoutSec
 	var idleTicker *time.Ticker
+	var idleFired atomic.Bool
 	if idle > 0 {
 		idleTicker = time.NewTicker(2 * time.Second)
 		defer idleTicker.Stop()
 		go func() {
 			for range idleTicker.C {
 				if time.Since(lastActivity) > time.Duration(idle)*time.Second {
+					idleFired.Store(true)
 					killProcessTree(cmd)
 					return
 				}
@@ -155,10 +423,13 @@ func runStream(req runRequest, stdout io.Writer) int {
 		}()
 	}
 
+	// Drain both pipes before Wait closes them so trailing lines are not lost.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() { defer readers.Done(); read(stdoutPipe, "stdout") }()
+	go func() { defer readers.Done(); read(stderrPipe, "stderr") }()
 	doneCh := make(chan error, 1)
-	go func() { doneCh <- cmd.Wait() }()
-	go read(stdoutPipe, "stdout")
-	go read(stderrPipe, "stderr")
+	go func() { readers.Wait(); doneCh <- cmd.Wait() }()
 
 	var exitCode int = 0
 	ok := true
@@ -170,6 +441,10 @@ func runStream(req runRequest, stdout io.Writer) int {
 		ok = false
 		exitCode = 124
 		reason = "timeout"
+		if errors.Is(err, context.Canceled) {
+			exitCode = 130
+			reason = "cancelled"
+		}
 		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error(), Reason: reason})
 	case err := <-doneCh:
 		if err != nil {
@@ -181,15 +456,46 @@ func runStream(req runRequest, stdout io.Writer) int {
 				exitCode = 1
 			}
 		}
+		if idleFired.Load() {
+			ok = false
+			exitCode = 124
+			reason = "idle-timeout"
+		}
 	}
-	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: &exitCode, Final: boolPtr(true), Reason: reason})
-	return 0
+	return attemptResult{ok: ok, exitCode: exitCode, reason: reason}
+}
+
+// lineEvent builds the event for one child output line: a json event when
+// parseJson applies and the line decodes, otherwise a stdout/stderr event.
+func lineEvent(req runRequest, kind, line string) ndjsonEvent {
+	if obj := jsonObjectLine(req.ParseJSON && kind == "stdout", line); obj != nil {
+		return ndjsonEvent{Action: "go", Event: "json", Extra: obj}
+	}
+	return ndjsonEvent{Action: "go", Event: kind, Data: line}
+}
+
+// jsonObjectLine decodes line when enabled and it holds a single JSON object;
+// otherwise it returns nil and the line is streamed as plain text.
+func jsonObjectLine(enabled bool, line string) map[string]interface{} {
+	if !enabled {
+		return nil
+	}
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &obj); err != nil || obj == nil {
+		return nil
+	}
+	return obj
 }
 
 func intPtr(i int) *int       { return &i }
 func boolPtr(b bool) *bool    { return &b }
 
 func main() {
+	sandboxInitIfRequested()
 	// Protocol handshake (v1)
 	writeEvent(os.Stdout, ndjsonEvent{Action: "go", Event: "hello", Extra: map[string]interface{}{"protocolVersion": "1", "goVersion": runtime.Version()}})
 	dec := json.NewDecoder(os.Stdin)
@@ -198,34 +504,72 @@ func main() {
 		fmt.Fprintln(os.Stderr, "invalid JSON request:", err)
 		os.Exit(2)
 	}
+	// Route events through a relay so the audit record sees the final outcome.
+	relay := &eventRelay{out: os.Stdout}
+	start := time.Now()
+	ok, known := dispatch(req, relay)
+	if !known {
+		fmt.Fprintln(os.Stderr, "unknown action")
+		os.Exit(2)
+	}
+	appendAudit(req, relay, time.Since(start))
+	if !ok { os.Exit(1) }
+}
+
+// dispatch runs a single action against stdout. It reports whether the action
+// succeeded and whether the action name was recognised at all. run-stream
+// always reports success: the child's outcome is carried by its done event.
+func dispatch(req runRequest, stdout io.Writer) (ok bool, known bool) {
 	switch req.Action {
 	case "run-stream", "run":
 		if req.Pty {
-			_ = runStreamPTY(req, os.Stdout)
+			_ = runStreamPTY(req, stdout)
 		} else {
-			_ = runStream(req, os.Stdout)
+			_ = runStream(req, stdout)
 		}
-		return
+		return true, true
 	case "zip-dir":
-		ok := zipDir(req.Src, req.Dest, req.Prefix, os.Stdout)
-		if !ok { os.Exit(1) }
-		return
+		return zipDir(req, stdout), true
 	case "tar-dir":
-		ok := tarDir(req.Src, req.Dest, req.Prefix, req.TarGz, os.Stdout)
-		if !ok { os.Exit(1) }
-		return
+		return tarDir(req, stdout), true
+	case "unzip":
+		return unzipArchive(req, stdout), true
+	case "untar":
+		return untarArchive(req, stdout), true
+	case "archive-list":
+		return listArchive(req, stdout), true
+	case "tree-diff":
+		return treeDiff(req, stdout), true
+	case "manifest":
+		return writeManifest(req, stdout), true
 	case "checksum-file":
-		ok := checksumFile(req.Src, req.Algo, os.Stdout)
-		if !ok { os.Exit(1) }
-		return
+		return checksumFile(req.Src, req.Algo, stdout), true
 	case "netlify-deploy-dir":
-		ok := netlifyDeployDir(req, os.Stdout)
-		if !ok { os.Exit(1) }
-		return
-	default:
-		fmt.Fprintln(os.Stderr, "unknown action")
-		os.Exit(2)
+		return netlifyDeployDir(req, stdout), true
+	case "pipeline":
+		return runPipeline(req, stdout), true
+	case "run-group":
+		return runGroup(req, stdout), true
+	case "matrix-run":
+		return runMatrix(req, stdout), true
+	case "replay":
+		return replayCast(req, stdout), true
+	case "spawn-bg":
+		return spawnBackground(req, stdout), true
+	case "ps":
+		return listProcs(req, stdout), true
+	case "logs":
+		return procLogs(req, stdout), true
+	case "stop":
+		return stopProc(req, stdout), true
+	case "wait-http":
+		return waitHTTP(req, stdout), true
+	case "wait-port":
+		return waitPort(req, stdout), true
+	case "audit-verify":
+		return verifyAudit(req, stdout), true
 	}
+	return false, false
 }
 
 type nlCreateReq struct {
@@ -267,22 +611,35 @@ func netlifyDeployDir(req runRequest, stdout io.Writer) bool {
     }
     writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "hashing"})
     files := map[string]string{}
-    // Build SHA1 map
+    // Pre-scan so hashing can report progress against the totals
+    var paths []string
+    var totalBytes int64
     walkErr := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
         if err != nil { return err }
         if d.IsDir() { return nil }
+        info, ierr := d.Info()
+        if ierr != nil { return ierr }
+        paths = append(paths, path)
+        totalBytes += info.Size()
+        return nil
+    })
+    // Build SHA1 map
+    progress := newProgressMeter(stdout, "hashing", len(paths), totalBytes)
+    for _, path := range paths {
+        if walkErr != nil { break }
         rel, rerr := filepath.Rel(src, path)
-        if rerr != nil { return rerr }
+        if rerr != nil { walkErr = rerr; break }
         // Netlify requires paths starting with '/'
         rel = "/" + filepath.ToSlash(rel)
         f, oerr := os.Open(path)
-        if oerr != nil { return oerr }
+        if oerr != nil { walkErr = oerr; break }
         h := sha1.New()
-        if _, cerr := io.Copy(h, f); cerr != nil { _ = f.Close(); return cerr }
+        if _, cerr := io.Copy(progress.wrap(h), f); cerr != nil { _ = f.Close(); walkErr = cerr; break }
         _ = f.Close()
         files[rel] = fmt.Sprintf("%x", h.Sum(nil))
-        return nil
-    })
+        progress.fileDone()
+    }
+    if walkErr == nil { progress.finish() }
     if walkErr != nil {
         ok := false
         writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: walkErr.Error()})
@@ -360,111 +717,6 @@ func firstNonEmpty(vals ...string) string {
     return ""
 }
 
-func zipDir(src, dest, prefix string, stdout io.Writer) bool {
-	if src == "" || dest == "" {
-		ok := false
-		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: "zip-dir: src and dest required"})
-		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
-		return false
-	}
-	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "zipping"})
-	f, err := os.Create(dest)
-	if err != nil {
-		ok := false
-		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error()})
-		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true)})
-		return false
-	}
-	defer f.Close()
-	zw := zip.NewWriter(f)
-	defer zw.Close()
-	// Walk src
-	err = filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
-		if err != nil { return err }
-		rel, rerr := filepath.Rel(src, path)
-		if rerr != nil { return rerr }
-		// Skip root
-		if rel == "." { return nil }
-		name := filepath.ToSlash(filepath.Join(prefix, rel))
-		if d.IsDir() {
-			// Ensure directory entries end with /
-			if !strings.HasSuffix(name, "/") { name += "/" }
-			_, werr := zw.Create(name)
-			return werr
-		}
-		// File entry
-		info, ierr := d.Info()
-		if ierr != nil { return ierr }
-		hdr, herr := zip.FileInfoHeader(info)
-		if herr != nil { return herr }
-		hdr.Name = name
-		hdr.Method = zip.Deflate
-		w, cerr := zw.CreateHeader(hdr)
-		if cerr != nil { return cerr }
-		rf, oerr := os.Open(path)
-		if oerr != nil { return oerr }
-		defer rf.Close()
-		if _, werr := io.Copy(w, rf); werr != nil { return werr }
-		return nil
-	})
-	ok := err == nil
-	if !ok { writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error()}) }
-	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(map[bool]int{true:0,false:1}[ok]), Final: boolPtr(true), Extra: map[string]interface{}{"dest": dest}})
-	return ok
-}
-
-// tarDir creates a tar (optionally gzipped) archive of src at dest.
-func tarDir(src, dest, prefix string, gz bool, stdout io.Writer) bool {
-	if src == "" || dest == "" {
-		ok := false
-		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: "tar-dir: src and dest required"})
-		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
-		return false
-	}
-	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "tarring"})
-	f, err := os.Create(dest)
-	if err != nil {
-		ok := false
-		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error()})
-		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true)})
-		return false
-	}
-	defer f.Close()
-	var tw *tar.Writer
-	var gw *gzip.Writer
-	var out io.Writer = f
-	if gz {
-		gw = gzip.NewWriter(f)
-		defer gw.Close()
-		out = gw
-	}
-	tw = tar.NewWriter(out)
-	defer tw.Close()
-	err = filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
-		if err != nil { return err }
-		rel, rerr := filepath.Rel(src, path)
-		if rerr != nil { return rerr }
-		if rel == "." { return nil }
-		name := filepath.ToSlash(filepath.Join(prefix, rel))
-		info, ierr := d.Info()
-		if ierr != nil { return ierr }
-		hdr, herr := tar.FileInfoHeader(info, "")
-		if herr != nil { return herr }
-		hdr.Name = name
-		if err := tw.WriteHeader(hdr); err != nil { return err }
-		if d.IsDir() { return nil }
-		rf, oerr := os.Open(path)
-		if oerr != nil { return oerr }
-		defer rf.Close()
-		if _, cerr := io.Copy(tw, rf); cerr != nil { return cerr }
-		return nil
-	})
-	ok := err == nil
-	if !ok { writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error()}) }
-	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(map[bool]int{true:0,false:1}[ok]), Final: boolPtr(true), Extra: map[string]interface{}{"dest": dest}})
-	return ok
-}
-
 // checksumFile computes a file digest (sha256 default) and emits it.
 func checksumFile(path, algo string, stdout io.Writer) bool {
 	if path == "" { ok := false; writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: "checksum-file: src required"}); writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"}); return false }
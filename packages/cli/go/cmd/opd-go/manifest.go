@@ -0,0 +1,319 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestEntryName is the file a manifest is embedded as, at the archive
+// root (below prefix).
+const manifestEntryName = "opd-manifest.json"
+
+// Values of the zip-dir/tar-dir manifest option.
+const (
+	manifestEmbed   = "embed"
+	manifestSidecar = "sidecar"
+)
+
+// manifestFile is one file in a deploy manifest. Symlinks kept by the
+// preserve policy are hashed by their target and carry it in link.
+type manifestFile struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Mode        string `json:"mode"`
+	SHA1        string `json:"sha1"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"contentType,omitempty"`
+	Link        string `json:"link,omitempty"`
+}
+
+// deployManifest maps every archived path to its content hashes.
+type deployManifest struct {
+	Version   int            `json:"version"`
+	Files     []manifestFile `json:"files"`
+	TotalSize int64          `json:"totalSize"`
+}
+
+func newDeployManifest() *deployManifest {
+	return &deployManifest{Version: 1, Files: []manifestFile{}}
+}
+
+// add records entry e, whose content went through d.
+func (m *deployManifest) add(e archiveEntry, d *fileDigest, req runRequest, epoch time.Time) {
+	mode := e.info.Mode()
+	if req.Reproducible {
+		mode, _ = normalizedEntry(e.info, epoch)
+	}
+	f := manifestFile{
+		Path:   e.rel,
+		Size:   d.size,
+		Mode:   fmt.Sprintf("%04o", mode.Perm()),
+		SHA1:   hex.EncodeToString(d.sha1.Sum(nil)),
+		SHA256: hex.EncodeToString(d.sha256.Sum(nil)),
+		Link:   e.link,
+	}
+	if e.link == "" {
+		f.ContentType = contentTypeFor(e.rel, d.head)
+	}
+	m.Files = append(m.Files, f)
+	m.TotalSize += d.size
+}
+
+// encode returns the manifest as indented JSON with files in path order, so
+// a reproducible archive embeds the same bytes every time.
+func (m *deployManifest) encode() []byte {
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	b, _ := json.MarshalIndent(m, "", "  ")
+	return append(b, '\n')
+}
+
+// fileDigest is an io.Writer computing the manifest hashes of a file while
+// it is copied, keeping the first bytes for content sniffing.
+type fileDigest struct {
+	sha1   hash.Hash
+	sha256 hash.Hash
+	head   []byte
+	size   int64
+}
+
+func newFileDigest() *fileDigest {
+	return &fileDigest{sha1: sha1.New(), sha256: sha256.New()}
+}
+
+func (d *fileDigest) Write(p []byte) (int, error) {
+	d.sha1.Write(p)
+	d.sha256.Write(p)
+	if n := 512 - len(d.head); n > 0 {
+		d.head = append(d.head, p[:min(n, len(p))]...)
+	}
+	d.size += int64(len(p))
+	return len(p), nil
+}
+
+// webContentTypes covers the assets of typical build outputs. A fixed table
+// (rather than mime.TypeByExtension, which reads host files) keeps manifests
+// identical across machines.
+var webContentTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".htm":         "text/html; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".cjs":         "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".xml":         "application/xml",
+	".txt":         "text/plain; charset=utf-8",
+	".md":          "text/markdown; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".rsc":         "text/x-component",
+	".svg":         "image/svg+xml",
+	".png":         "image/png",
+	".jpg":         "image/jpeg",
+	".jpeg":        "image/jpeg",
+	".gif":         "image/gif",
+	".webp":        "image/webp",
+	".avif":        "image/avif",
+	".ico":         "image/x-icon",
+	".bmp":         "image/bmp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".ttf":         "font/ttf",
+	".otf":         "font/otf",
+	".eot":         "application/vnd.ms-fontobject",
+	".mp4":         "video/mp4",
+	".webm":        "video/webm",
+	".mp3":         "audio/mpeg",
+	".ogg":         "audio/ogg",
+	".wav":         "audio/wav",
+	".pdf":         "application/pdf",
+	".wasm":        "application/wasm",
+	".zip":         "application/zip",
+	".gz":          "application/gzip",
+}
+
+// contentTypeFor picks the content type by extension, falling back to
+// sniffing the first bytes.
+func contentTypeFor(name string, head []byte) string {
+	if t, ok := webContentTypes[strings.ToLower(path.Ext(name))]; ok {
+		return t
+	}
+	return http.DetectContentType(head)
+}
+
+// embeddedManifestName is where the manifest goes in an archive.
+func embeddedManifestName(req runRequest) string {
+	return path.Join(strings.Trim(req.Prefix, "/"), manifestEntryName)
+}
+
+// manifestTime is the mtime of an embedded manifest.
+func manifestTime(req runRequest, epoch time.Time) time.Time {
+	if req.Reproducible {
+		return epoch
+	}
+	return time.Now().Truncate(time.Second)
+}
+
+func embedManifestZip(zw *zip.Writer, m *deployManifest, req runRequest, epoch time.Time) error {
+	hdr := &zip.FileHeader{Name: embeddedManifestName(req), Method: zip.Deflate, Modified: manifestTime(req, epoch)}
+	hdr.SetMode(0o644)
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(m.encode())
+	return err
+}
+
+func embedManifestTar(tw *tar.Writer, m *deployManifest, req runRequest, epoch time.Time) error {
+	data := m.encode()
+	hdr := &tar.Header{Name: embeddedManifestName(req), Mode: 0o644, Size: int64(len(data)), ModTime: manifestTime(req, epoch), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// sidecarManifestPath is where manifest: "sidecar" writes next to dest.
+func sidecarManifestPath(dest string) string {
+	return dest + ".manifest.json"
+}
+
+// archiveManifest validates req.Manifest and returns the manifest to fill
+// while archiving, or nil when none was asked for.
+func archiveManifest(req runRequest) (*deployManifest, error) {
+	switch req.Manifest {
+	case "":
+		return nil, nil
+	case manifestEmbed, manifestSidecar:
+		return newDeployManifest(), nil
+	}
+	return nil, fmt.Errorf("%s: manifest must be embed or sidecar", req.Action)
+}
+
+// digestEntry copies the content of e (a file, or a preserved link's target)
+// through a new fileDigest into w and records it in m.
+func digestEntry(w io.Writer, e archiveEntry, m *deployManifest, req runRequest, epoch time.Time) error {
+	d := newFileDigest()
+	var err error
+	if e.link != "" {
+		_, err = io.WriteString(io.MultiWriter(w, d), e.link)
+	} else {
+		err = copyFileTo(io.MultiWriter(w, d), e.path)
+	}
+	if err == nil {
+		m.add(e, d, req, epoch)
+	}
+	return err
+}
+
+// writeManifest hashes the files below req.Src that zip-dir would archive
+// and writes the manifest to req.Dest.
+func writeManifest(req runRequest, stdout io.Writer) bool {
+	if req.Src == "" || req.Dest == "" {
+		return archiveFail(stdout, "manifest: src and dest required", "invalid-args")
+	}
+	switch req.Symlinks {
+	case "", symlinksFollow, symlinksPreserve, symlinksReject:
+	default:
+		return archiveFail(stdout, "manifest: symlinks must be follow, preserve or reject", "invalid-args")
+	}
+	var epoch time.Time
+	if req.Reproducible {
+		var err error
+		if epoch, err = reproducibleEpoch(); err != nil {
+			return archiveFail(stdout, err.Error(), "invalid-args")
+		}
+	}
+	filter, err := loadArchiveFilter(req)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "invalid-args")
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "hashing"})
+	f, err := createArchiveFile(req.Dest)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "")
+	}
+	m := newDeployManifest()
+	scan, err := collectEntries(req, filter, req.Dest, f.Name())
+	var progress *progressMeter
+	if err == nil {
+		progress = scanProgress(stdout, "hashing", scan)
+		for _, e := range scan.entries {
+			if e.info.IsDir() {
+				continue
+			}
+			w := io.Discard
+			if e.link == "" {
+				w = progress.wrap(w)
+			}
+			if err = digestEntry(w, e, m, req, epoch); err != nil {
+				break
+			}
+			progress.fileDone()
+		}
+	}
+	if err == nil {
+		_, err = f.Write(m.encode())
+	}
+	err = f.finish(err)
+	var extra map[string]interface{}
+	if err == nil {
+		progress.finish()
+		extra = map[string]interface{}{"files": len(m.Files), "totalSize": m.TotalSize}
+	}
+	return archiveDone(req, scan, extra, err, stdout)
+}
+
+// checkManifestName refuses to embed a manifest over a file of the same name
+// from src.
+func checkManifestName(req runRequest, scan *archiveScan) error {
+	if req.Manifest != manifestEmbed {
+		return nil
+	}
+	for _, e := range scan.entries {
+		if e.rel == manifestEntryName {
+			return &archiveError{reason: "invalid-args", err: fmt.Errorf("%s: src already contains %s", req.Action, manifestEntryName)}
+		}
+	}
+	return nil
+}
+
+// finishArchive completes the archive f and, for manifest: "sidecar", the
+// manifest next to it. The sidecar is written to its temp file first, so on
+// any failure before the archive is renamed neither file is replaced. It
+// returns the done.extra fields describing the manifest.
+func finishArchive(f *archiveFile, req runRequest, m *deployManifest, err error) (map[string]interface{}, error) {
+	var sidecar *archiveFile
+	if err == nil && req.Manifest == manifestSidecar {
+		if sidecar, err = createArchiveFile(sidecarManifestPath(req.Dest)); err == nil {
+			_, err = sidecar.Write(m.encode())
+		}
+	}
+	err = f.finish(err)
+	if sidecar != nil {
+		err = sidecar.finish(err)
+	}
+	if m == nil || err != nil {
+		return nil, err
+	}
+	extra := map[string]interface{}{"manifestFiles": len(m.Files), "manifest": embeddedManifestName(req)}
+	if req.Manifest == manifestSidecar {
+		extra["manifest"] = sidecarManifestPath(req.Dest)
+	}
+	return extra, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// matrixRefPattern matches ${matrix.<axis>} placeholders in a command template.
+var matrixRefPattern = regexp.MustCompile(`\$\{matrix\.([A-Za-z0-9_-]+)\}`)
+
+// runMatrix expands req.Axes into every combination of axis values and runs
+// req.Cmd once per cell. Each cell receives its axis values as env vars and in
+// ${matrix.<axis>} placeholders; cells run through runCommands like a group.
+func runMatrix(req runRequest, stdout io.Writer) bool {
+	if req.Cmd == "" || len(req.Axes) == 0 {
+		ok := false
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: "matrix-run: cmd and axes required"})
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+		return false
+	}
+	keys := make([]string, 0, len(req.Axes))
+	for k, vals := range req.Axes {
+		if len(vals) == 0 {
+			ok := false
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: fmt.Sprintf("matrix-run: axis %q has no values", k)})
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+			return false
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, m := range matrixRefPattern.FindAllStringSubmatch(req.Cmd, -1) {
+		if _, ok := req.Axes[m[1]]; !ok {
+			ok := false
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: fmt.Sprintf("matrix-run: unknown axis %q in cmd", m[1])})
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+			return false
+		}
+	}
+
+	cells := expandMatrix(keys, req.Axes)
+	cmds := make([]runRequest, len(cells))
+	for i, cell := range cells {
+		parts := make([]string, len(keys))
+		for j, k := range keys {
+			parts[j] = k + "=" + cell[k]
+		}
+		c := inheritRunDefaults(req, runRequest{Name: strings.Join(parts, ",")})
+		c.Cmd = matrixRefPattern.ReplaceAllStringFunc(req.Cmd, func(m string) string {
+			return cell[matrixRefPattern.FindStringSubmatch(m)[1]]
+		})
+		env := map[string]string{}
+		for k, v := range c.Env {
+			env[k] = v
+		}
+		for k, v := range cell {
+			env[k] = v
+		}
+		c.Env = env
+		cmds[i] = c
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: fmt.Sprintf("matrix: %d cells", len(cmds))})
+	results, ok := runCommands(cmds, req.Concurrency, req.FailFast, stdout)
+	for i, r := range results {
+		r["matrix"] = cells[i]
+	}
+	return finishGroup(results, ok, map[string]interface{}{"axes": keys}, stdout)
+}
+
+// expandMatrix returns the cartesian product of axes in keys order, with the
+// last key varying fastest.
+func expandMatrix(keys []string, axes map[string][]string) []map[string]string {
+	cells := []map[string]string{{}}
+	for _, k := range keys {
+		next := make([]map[string]string, 0, len(cells)*len(axes[k]))
+		for _, cell := range cells {
+			for _, v := range axes[k] {
+				c := make(map[string]string, len(cell)+1)
+				for ck, cv := range cell {
+					c[ck] = cv
+				}
+				c[k] = v
+				next = append(next, c)
+			}
+		}
+		cells = next
+	}
+	return cells
+}
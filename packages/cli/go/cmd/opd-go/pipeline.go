@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// stepRefPattern matches ${steps.<name>.<key>} references to an earlier
+// step's done.extra fields.
+var stepRefPattern = regexp.MustCompile(`\$\{steps\.([A-Za-z0-9_-]+)\.([A-Za-z0-9_-]+)\}`)
+
+// runPipeline executes req.Steps in order, stopping at the first failure.
+// Every event a step emits is tagged with the step name; the step's own done
+// event is forwarded as a non-final "step-done" and a single combined done
+// closes the pipeline.
+func runPipeline(req runRequest, stdout io.Writer) bool {
+	if len(req.Steps) == 0 {
+		ok := false
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: "pipeline: steps required"})
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+		return false
+	}
+	outputs := map[string]map[string]interface{}{}
+	steps := make([]map[string]interface{}, 0, len(req.Steps))
+	failed := ""
+	exitCode := 0
+	for i, step := range req.Steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step%d", i+1)
+		}
+		summary := map[string]interface{}{"name": name, "action": step.Action}
+		steps = append(steps, summary)
+		fail := func(msg, reason string) {
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Name: name, Error: msg, Reason: reason})
+			summary["ok"] = false
+			summary["exitCode"] = 1
+			summary["reason"] = reason
+			failed = name
+			exitCode = 1
+		}
+		if _, dup := outputs[name]; dup {
+			fail(fmt.Sprintf("pipeline: duplicate step name %q", name), "invalid-args")
+			break
+		}
+		if step.Action == "pipeline" {
+			fail("pipeline: nested pipelines are not supported", "invalid-args")
+			break
+		}
+		resolved, err := resolveStepRefs(step, outputs)
+		if err != nil {
+			fail(err.Error(), "invalid-args")
+			break
+		}
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Name: name, Data: fmt.Sprintf("step %d/%d: %s", i+1, len(req.Steps), step.Action)})
+		relay := &eventRelay{out: stdout, hook: func(ev *ndjsonEvent) bool {
+			ev.Name = name
+			if ev.Event == "done" {
+				ev.Event = "step-done"
+				ev.Final = nil
+			}
+			return true
+		}}
+		start := time.Now()
+		_, known := dispatch(resolved, relay)
+		if !known {
+			fail(fmt.Sprintf("pipeline: unknown action %q", step.Action), "invalid-args")
+			break
+		}
+		ok, code, reason, extra := relay.result()
+		summary["ok"] = ok
+		summary["exitCode"] = code
+		summary["durationMs"] = time.Since(start).Milliseconds()
+		if reason != "" {
+			summary["reason"] = reason
+		}
+		if extra != nil {
+			summary["extra"] = extra
+		}
+		outputs[name] = extra
+		if !ok {
+			failed = name
+			exitCode = code
+			if exitCode == 0 {
+				exitCode = 1
+			}
+			break
+		}
+	}
+	ok := failed == ""
+	extra := map[string]interface{}{"steps": steps}
+	reason := ""
+	if !ok {
+		extra["failedStep"] = failed
+		reason = "step-failed"
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: &exitCode, Final: boolPtr(true), Reason: reason, Extra: extra})
+	return ok
+}
+
+// resolveStepRefs substitutes ${steps.<name>.<key>} references in every string
+// field of step with values from earlier steps' done.extra.
+func resolveStepRefs(step runRequest, outputs map[string]map[string]interface{}) (runRequest, error) {
+	raw, err := json.Marshal(step)
+	if err != nil {
+		return step, err
+	}
+	var tree interface{}
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return step, err
+	}
+	var refErr error
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch t := v.(type) {
+		case string:
+			return stepRefPattern.ReplaceAllStringFunc(t, func(m string) string {
+				sub := stepRefPattern.FindStringSubmatch(m)
+				extra, ok := outputs[sub[1]]
+				if !ok {
+					refErr = fmt.Errorf("pipeline: unknown step %q in %s", sub[1], m)
+					return m
+				}
+				val, ok := extra[sub[2]]
+				if !ok {
+					refErr = fmt.Errorf("pipeline: step %q has no output %q", sub[1], sub[2])
+					return m
+				}
+				return fmt.Sprint(val)
+			})
+		case map[string]interface{}:
+			for k, e := range t {
+				t[k] = walk(e)
+			}
+		case []interface{}:
+			for i, e := range t {
+				t[i] = walk(e)
+			}
+		}
+		return v
+	}
+	tree = walk(tree)
+	if refErr != nil {
+		return step, refErr
+	}
+	raw, err = json.Marshal(tree)
+	if err != nil {
+		return step, err
+	}
+	var out runRequest
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return step, err
+	}
+	return out, nil
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandPolicy is the optional .opendeploy/policy.json (or $OPD_POLICY_FILE)
+// restricting what command-running actions may execute.
+type commandPolicy struct {
+	AllowExecutables []string `json:"allowExecutables,omitempty"`
+	DenyExecutables  []string `json:"denyExecutables,omitempty"`
+	AllowArgs        []string `json:"allowArgs,omitempty"`
+	DenyArgs         []string `json:"denyArgs,omitempty"`
+	ForbiddenEnv     []string `json:"forbiddenEnv,omitempty"`
+	CwdRoots         []string `json:"cwdRoots,omitempty"`
+
+	path      string
+	root      string
+	allowArgs []*regexp.Regexp
+	denyArgs  []*regexp.Regexp
+	loadErr   error
+}
+
+var (
+	policyOnce   sync.Once
+	activePolicy *commandPolicy
+)
+
+// loadPolicy reads the policy once per process. A missing file disables
+// enforcement; an unreadable or invalid one denies every command.
+func loadPolicy() *commandPolicy {
+	policyOnce.Do(func() {
+		p := os.Getenv("OPD_POLICY_FILE")
+		if p == "" {
+			p = filepath.Join(".opendeploy", "policy.json")
+			if _, err := os.Stat(p); errors.Is(err, fs.ErrNotExist) {
+				return
+			}
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			abs = p
+		}
+		pol := &commandPolicy{path: abs}
+		// Relative cwdRoots and the decision log hang off the project root:
+		// the parent of .opendeploy, or the policy file's own directory.
+		pol.root = filepath.Dir(abs)
+		if filepath.Base(pol.root) == ".opendeploy" {
+			pol.root = filepath.Dir(pol.root)
+		}
+		activePolicy = pol
+		b, err := os.ReadFile(abs)
+		if err == nil {
+			err = json.Unmarshal(b, pol)
+		}
+		if err != nil {
+			pol.loadErr = fmt.Errorf("policy %s: %v", abs, err)
+			return
+		}
+		for _, pat := range pol.AllowArgs {
+			re, cerr := regexp.Compile(pat)
+			if cerr != nil {
+				pol.loadErr = fmt.Errorf("policy %s: allowArgs %q: %v", abs, pat, cerr)
+				return
+			}
+			pol.allowArgs = append(pol.allowArgs, re)
+		}
+		for _, pat := range pol.DenyArgs {
+			re, cerr := regexp.Compile(pat)
+			if cerr != nil {
+				pol.loadErr = fmt.Errorf("policy %s: denyArgs %q: %v", abs, pat, cerr)
+				return
+			}
+			pol.denyArgs = append(pol.denyArgs, re)
+		}
+	})
+	return activePolicy
+}
+
+// enforcePolicy checks a command-running request against the active policy
+// and logs the decision. It returns a non-nil error when the request must be
+// rejected with reason "policy-denied".
+func enforcePolicy(action string, req runRequest) error {
+	pol := loadPolicy()
+	if pol == nil {
+		return nil
+	}
+	err := pol.check(req)
+	pol.logDecision(action, req, err)
+	return err
+}
+
+func (p *commandPolicy) check(req runRequest) error {
+	if p.loadErr != nil {
+		return p.loadErr
+	}
+	for k := range req.Env {
+		for _, pat := range p.ForbiddenEnv {
+			if ok, _ := path.Match(pat, k); ok || strings.EqualFold(pat, k) {
+				return fmt.Errorf("env key %s is forbidden", k)
+			}
+		}
+	}
+	if len(p.CwdRoots) > 0 {
+		if err := p.checkCwd(req.Cwd); err != nil {
+			return err
+		}
+	}
+	return p.checkCommand(req.Cmd, 0)
+}
+
+// maxNestedShells bounds how deep sh -c / env -S scripts are unwrapped.
+const maxNestedShells = 4
+
+// checkCommand applies the executable and argument rules to every segment of
+// cmd, including the programs run through wrappers like env or nice and the
+// scripts passed to sh -c. Substitutions and subshells are always rejected:
+// their contents cannot be checked.
+func (p *commandPolicy) checkCommand(cmd string, depth int) error {
+	if depth > maxNestedShells {
+		return errors.New("shell commands are nested too deeply to check")
+	}
+	if s := findSubstitution(cmd); s != "" {
+		return fmt.Errorf("%s is not allowed under a command policy", s)
+	}
+	for _, seg := range splitCommandSegments(cmd) {
+		if strings.HasPrefix(seg, "(") || strings.HasPrefix(seg, "{") {
+			return fmt.Errorf("subshells and command groups are not allowed under a command policy: %q", seg)
+		}
+		exes, scripts := segmentExecutables(seg)
+		for _, exe := range exes {
+			for _, d := range p.DenyExecutables {
+				if executableMatches(d, exe) {
+					return fmt.Errorf("executable %s is denied", exe)
+				}
+			}
+			if len(p.AllowExecutables) > 0 {
+				allowed := false
+				for _, a := range p.AllowExecutables {
+					if executableMatches(a, exe) {
+						allowed = true
+						break
+					}
+				}
+				if !allowed {
+					return fmt.Errorf("executable %s is not allowed", exe)
+				}
+			}
+		}
+		for _, re := range p.denyArgs {
+			if re.MatchString(seg) {
+				return fmt.Errorf("arguments %q match denied pattern %s", seg, re)
+			}
+		}
+		if len(p.allowArgs) > 0 {
+			allowed := false
+			for _, re := range p.allowArgs {
+				if re.MatchString(seg) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return fmt.Errorf("arguments %q match no allowed pattern", seg)
+			}
+		}
+		for _, script := range scripts {
+			if err := p.checkCommand(script, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findSubstitution returns the first command or process substitution
+// (`…`, $(…), <(…), >(…)) in cmd outside single quotes, or "".
+func findSubstitution(cmd string) string {
+	var quote rune
+	escaped := false
+	var prev rune
+	for _, r := range cmd {
+		switch {
+		case escaped:
+			escaped = false
+			r = 0
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			}
+		case r == '\\':
+			escaped = true
+		case r == '`':
+			return "command substitution (`…`)"
+		case r == '(' && prev == '$':
+			return "command substitution ($(…))"
+		case r == '(' && (prev == '<' || prev == '>') && quote == 0:
+			return "process substitution"
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		}
+		prev = r
+	}
+	return ""
+}
+
+// checkCwd requires the (symlink-resolved) working directory to sit inside
+// one of the configured roots.
+func (p *commandPolicy) checkCwd(cwd string) error {
+	if cwd == "" {
+		cwd = "."
+	}
+	abs, err := filepath.Abs(cwd)
+	if err != nil {
+		return err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = real
+	}
+	for _, r := range p.CwdRoots {
+		if !filepath.IsAbs(r) {
+			r = filepath.Join(p.root, r)
+		}
+		if real, err := filepath.EvalSymlinks(r); err == nil {
+			r = real
+		}
+		if within(r, abs) {
+			return nil
+		}
+	}
+	return fmt.Errorf("cwd %s is outside the allowed roots", abs)
+}
+
+// within reports whether path is root or below it.
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// splitCommandSegments splits a shell command line on the control operators
+// ;, &, |, &&, || and newlines, ignoring operators inside quotes.
+func splitCommandSegments(cmd string) []string {
+	var segs []string
+	var cur strings.Builder
+	var quote rune
+	escaped := false
+	flush := func() {
+		if s := strings.TrimSpace(cur.String()); s != "" {
+			segs = append(segs, s)
+		}
+		cur.Reset()
+	}
+	for _, r := range cmd {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ';' || r == '&' || r == '|' || r == '\n':
+			flush()
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	flush()
+	return segs
+}
+
+// commandWrappers run the command given in their arguments. The value lists
+// the options that take a separate argument.
+var commandWrappers = map[string][]string{
+	"env":     {"-u", "--unset", "-C", "--chdir"},
+	"command": nil,
+	"exec":    {"-a"},
+	"nice":    {"-n", "--adjustment"},
+	"nohup":   nil,
+	"time":    {"-f", "--format", "-o", "--output"},
+}
+
+// shellPrograms take a script to run with -c.
+var shellPrograms = map[string]bool{"sh": true, "bash": true, "dash": true, "zsh": true, "ksh": true}
+
+// segmentExecutables returns the normalised program names a command segment
+// runs: its program, skipping leading VAR=value assignments, and the program
+// behind each wrapper (env, command, exec, nice, nohup, time). Scripts passed
+// to a shell with -c, or to env -S, are returned for checking in turn.
+func segmentExecutables(seg string) (exes, scripts []string) {
+	fields := shellFields(seg)
+	i := 0
+	for i < len(fields) {
+		if isAssignment(fields[i]) {
+			i++
+			continue
+		}
+		exe := normalizeExecutable(fields[i])
+		exes = append(exes, exe)
+		i++
+		if shellPrograms[exe] {
+			for ; i < len(fields) && strings.HasPrefix(fields[i], "-"); i++ {
+				if !strings.HasPrefix(fields[i], "--") && strings.Contains(fields[i], "c") && i+1 < len(fields) {
+					scripts = append(scripts, fields[i+1])
+					break
+				}
+			}
+			return exes, scripts
+		}
+		argFlags, ok := commandWrappers[exe]
+		if !ok {
+			return exes, scripts
+		}
+		for i < len(fields) && strings.HasPrefix(fields[i], "-") {
+			f := fields[i]
+			i++
+			if f == "--" {
+				break
+			}
+			if exe == "env" && (f == "-S" || f == "--split-string") && i < len(fields) {
+				scripts = append(scripts, fields[i])
+				return exes, scripts
+			}
+			if exe == "env" && strings.HasPrefix(f, "--split-string=") {
+				scripts = append(scripts, strings.TrimPrefix(f, "--split-string="))
+				return exes, scripts
+			}
+			for _, a := range argFlags {
+				if f == a {
+					i++
+				}
+			}
+		}
+	}
+	return exes, scripts
+}
+
+func isAssignment(f string) bool {
+	eq := strings.Index(f, "=")
+	return eq > 0 && !strings.ContainsAny(f[:eq], `/\"'-`)
+}
+
+// normalizeExecutable strips the directory and, on Windows, the case and
+// executable extension from a program name.
+func normalizeExecutable(f string) string {
+	f = filepath.Base(filepath.FromSlash(f))
+	if runtime.GOOS == "windows" {
+		f = strings.ToLower(f)
+		for _, ext := range []string{".exe", ".cmd", ".bat", ".ps1"} {
+			f = strings.TrimSuffix(f, ext)
+		}
+	}
+	return f
+}
+
+// shellFields splits a command segment into words the way sh would, removing
+// quotes and backslash escapes.
+func shellFields(seg string) []string {
+	var fields []string
+	var cur strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range seg {
+		switch {
+		case escaped:
+			escaped = false
+			cur.WriteRune(r)
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
+
+func executableMatches(pattern, exe string) bool {
+	if runtime.GOOS == "windows" {
+		pattern = strings.ToLower(pattern)
+	}
+	ok, _ := path.Match(pattern, exe)
+	return ok
+}
+
+// logDecision appends the decision to <root>/.opendeploy/logs/policy.jsonl.
+func (p *commandPolicy) logDecision(action string, req runRequest, err error) {
+	rec := map[string]interface{}{
+		"ts":       time.Now().UTC().Format(time.RFC3339Nano),
+		"action":   action,
+		"cmd":      redactCommand(req.Cmd),
+		"cwd":      req.Cwd,
+		"decision": "allow",
+	}
+	if err != nil {
+		rec["decision"] = "deny"
+		rec["reason"] = err.Error()
+	}
+	dir := filepath.Join(p.root, ".opendeploy", "logs")
+	if mkErr := os.MkdirAll(dir, 0o755); mkErr != nil {
+		return
+	}
+	f, oerr := os.OpenFile(filepath.Join(dir, "policy.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if oerr != nil {
+		return
+	}
+	defer f.Close()
+	b, _ := json.Marshal(rec)
+	_, _ = f.Write(append(b, '\n'))
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestPolicyDenyWrappers(t *testing.T) {
+	p := &commandPolicy{DenyExecutables: []string{"curl"}}
+	denied := []string{
+		"curl x",
+		"echo $(curl x)",
+		"echo \"$(curl x)\"",
+		"echo `curl x`",
+		"cat <(curl x)",
+		"(curl x)",
+		"{ curl x; }",
+		"env curl x",
+		"env -i FOO=1 /usr/bin/curl x",
+		"env -S 'curl x'",
+		"command curl x",
+		"exec -a name curl x",
+		"nice -n 5 curl x",
+		"nohup curl x",
+		"sh -c 'curl x'",
+		"bash -lc \"curl x\"",
+		"sh -c 'sh -c \"curl x\"'",
+		"FOO=1 \"curl\" x",
+		"pnpm build; curl x",
+	}
+	for _, cmd := range denied {
+		if err := p.check(runRequest{Cmd: cmd}); err == nil {
+			t.Errorf("%q allowed", cmd)
+		}
+	}
+	allowed := []string{
+		"pnpm build && node dist/index.js",
+		"env FOO=1 node x.js",
+		"sh -c 'node x.js'",
+		"echo 'curl $(x)'",
+		"echo \"a (b)\"",
+		"git log --format='%h (%s)'",
+	}
+	for _, cmd := range allowed {
+		if err := p.check(runRequest{Cmd: cmd}); err != nil {
+			t.Errorf("%q denied: %v", cmd, err)
+		}
+	}
+}
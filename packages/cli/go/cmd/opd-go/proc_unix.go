@@ -4,7 +4,11 @@
 package main
 
 import (
+    "fmt"
+    "os"
     "os/exec"
+    "strconv"
+    "strings"
     "syscall"
     "time"
 )
@@ -33,3 +37,60 @@ func killProcessTree(cmd *exec.Cmd) {
     time.Sleep(500 * time.Millisecond)
     _ = syscall.Kill(-pgid, syscall.SIGKILL)
 }
+
+// processAlive reports whether pid still refers to a running process. With
+// a startTime recorded by processStartTime, a process that has since taken
+// over the pid counts as gone.
+func processAlive(pid int, startTime string) bool {
+    if pid <= 0 {
+        return false
+    }
+    if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+        return false
+    }
+    // An exited child nobody has reaped yet still answers signal 0; where
+    // /proc is available, treat zombies as gone.
+    if stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+        if i := strings.LastIndexByte(string(stat), ')'); i >= 0 && strings.HasPrefix(string(stat[i+1:]), " Z") {
+            return false
+        }
+    }
+    if startTime != "" && processStartTime(pid) != startTime {
+        return false
+    }
+    return true
+}
+
+// processStartTime identifies the process currently holding pid: its start
+// time in clock ticks since boot from /proc/<pid>/stat, or the start time
+// from ps where there is no /proc. It returns "" when pid is not running.
+func processStartTime(pid int) string {
+    stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+    if err == nil {
+        // Fields after the parenthesised command name start at field 3;
+        // starttime is field 22.
+        if i := strings.LastIndexByte(string(stat), ')'); i >= 0 {
+            if f := strings.Fields(string(stat[i+1:])); len(f) > 19 {
+                return f[19]
+            }
+        }
+        return ""
+    }
+    if _, serr := os.Stat("/proc/self/stat"); serr == nil {
+        return ""
+    }
+    out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+    if err != nil {
+        return ""
+    }
+    return strings.TrimSpace(string(out))
+}
+
+// processGroup returns the process group of pid, falling back to pid itself
+// (the group leader when started via setProcessGroup).
+func processGroup(pid int) int {
+    if pgid, err := syscall.Getpgid(pid); err == nil {
+        return pgid
+    }
+    return pid
+}
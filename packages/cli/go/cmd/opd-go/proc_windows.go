@@ -6,6 +6,7 @@ package main
 import (
     "fmt"
     "os/exec"
+    "syscall"
 )
 
 // setProcessGroup is a no-op on Windows for now. Job Objects would be ideal,
@@ -21,3 +22,48 @@ func killProcessTree(cmd *exec.Cmd) {
     }
     _ = exec.Command("taskkill", "/T", "/F", "/PID", fmt.Sprintf("%d", cmd.Process.Pid)).Run()
 }
+
+// processAlive reports whether pid still refers to a running process. With
+// a startTime recorded by processStartTime, a process that has since taken
+// over the pid counts as gone.
+func processAlive(pid int, startTime string) bool {
+    if pid <= 0 {
+        return false
+    }
+    const processQueryLimitedInformation = 0x1000
+    const stillActive = 259
+    h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+    if err != nil {
+        return false
+    }
+    defer syscall.CloseHandle(h)
+    var code uint32
+    if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+        return false
+    }
+    if code != stillActive {
+        return false
+    }
+    return startTime == "" || processStartTime(pid) == startTime
+}
+
+// processStartTime identifies the process currently holding pid by its
+// creation time, or returns "" when it cannot be opened.
+func processStartTime(pid int) string {
+    const processQueryLimitedInformation = 0x1000
+    h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+    if err != nil {
+        return ""
+    }
+    defer syscall.CloseHandle(h)
+    var created, exited, kernel, user syscall.Filetime
+    if err := syscall.GetProcessTimes(h, &created, &exited, &kernel, &user); err != nil {
+        return ""
+    }
+    return fmt.Sprintf("%d", created.Nanoseconds())
+}
+
+// processGroup has no Windows equivalent; taskkill /T walks the tree instead.
+func processGroup(pid int) int {
+    return 0
+}
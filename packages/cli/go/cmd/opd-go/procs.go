@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// procEntry is one background process recorded in .opendeploy/procs/<id>.json.
+type procEntry struct {
+	ID        string `json:"id"`
+	Pid       int    `json:"pid"`
+	Pgid      int    `json:"pgid,omitempty"`
+	Cmd       string `json:"cmd"`
+	Cwd       string `json:"cwd,omitempty"`
+	StartedAt string `json:"startedAt"`
+	LogFile   string `json:"logFile"`
+	// StartTime tells the recorded process apart from a later one reusing
+	// its pid (see processStartTime).
+	StartTime string `json:"startTime,omitempty"`
+}
+
+// alive reports whether the recorded process is still the one running.
+func (e procEntry) alive() bool {
+	return processAlive(e.Pid, e.StartTime)
+}
+
+func (e procEntry) extra() map[string]interface{} {
+	return map[string]interface{}{"id": e.ID, "pid": e.Pid, "pgid": e.Pgid, "cmd": e.Cmd, "cwd": e.Cwd, "startedAt": e.StartedAt, "logFile": e.LogFile}
+}
+
+// procsDir is the registry directory for the project rooted at cwd.
+func procsDir(cwd string) string {
+	if cwd == "" {
+		cwd = "."
+	}
+	return filepath.Join(cwd, ".opendeploy", "procs")
+}
+
+func readProcEntry(dir, id string) (procEntry, error) {
+	var e procEntry
+	b, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return e, err
+	}
+	err = json.Unmarshal(b, &e)
+	return e, err
+}
+
+func writeProcEntry(dir string, e procEntry) error {
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, e.ID+".json.tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, e.ID+".json"))
+}
+
+// validProcID keeps registry ids usable as plain file names.
+func validProcID(id string) bool {
+	return id != "" && filepath.IsLocal(id) && !strings.ContainsAny(id, `/\`)
+}
+
+func procFail(stdout io.Writer, msg, reason string) bool {
+	ok := false
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: msg, Reason: reason})
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: reason})
+	return false
+}
+
+// spawnBackground starts req.Cmd detached in its own process group with
+// output appended to <id>.log, records it in the registry and returns
+// without waiting for it.
+func spawnBackground(req runRequest, stdout io.Writer) bool {
+	if req.Cmd == "" {
+		return procFail(stdout, "spawn-bg: cmd required", "invalid-args")
+	}
+	id := req.Name
+	if id == "" {
+		id = fmt.Sprintf("bg-%d", time.Now().UnixNano())
+	}
+	if !validProcID(id) {
+		return procFail(stdout, fmt.Sprintf("spawn-bg: invalid name %q", id), "invalid-args")
+	}
+	if err := enforcePolicy("spawn-bg", req); err != nil {
+		return procFail(stdout, err.Error(), "policy-denied")
+	}
+	dir := procsDir(req.Cwd)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return procFail(stdout, err.Error(), "")
+	}
+	if prev, err := readProcEntry(dir, id); err == nil && prev.alive() {
+		return procFail(stdout, fmt.Sprintf("spawn-bg: %q is already running (pid %d)", id, prev.Pid), "already-running")
+	}
+	logPath, err := filepath.Abs(filepath.Join(dir, id+".log"))
+	if err != nil {
+		return procFail(stdout, err.Error(), "")
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return procFail(stdout, err.Error(), "")
+	}
+	defer logFile.Close()
+
+	cmd := shellCommand(req.Cmd)
+	if req.Cwd != "" {
+		cmd.Dir = req.Cwd
+	}
+	if req.Env != nil {
+		env := os.Environ()
+		for k, v := range req.Env {
+			if k == "" { continue }
+			env = append(env, fmt.Sprintf("%s=%s", k, v))
+		}
+		cmd.Env = env
+	}
+	setProcessGroup(cmd)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return procFail(stdout, err.Error(), "start-failed")
+	}
+	cwd, _ := filepath.Abs(cmd.Dir)
+	entry := procEntry{
+		ID:        id,
+		Pid:       cmd.Process.Pid,
+		Pgid:      processGroup(cmd.Process.Pid),
+		Cmd:       req.Cmd,
+		Cwd:       cwd,
+		StartedAt: time.Now().UTC().Format(time.RFC3339),
+		LogFile:   logPath,
+		StartTime: processStartTime(cmd.Process.Pid),
+	}
+	if err := writeProcEntry(dir, entry); err != nil {
+		killProcessTree(cmd)
+		return procFail(stdout, err.Error(), "")
+	}
+	_ = cmd.Process.Release()
+	ok := true
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(0), Final: boolPtr(true), Extra: entry.extra()})
+	return true
+}
+
+// listProcs emits one "proc" event per live registry entry and prunes
+// entries whose processes have exited.
+func listProcs(req runRequest, stdout io.Writer) bool {
+	dir := procsDir(req.Cwd)
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return procFail(stdout, err.Error(), "")
+	}
+	sort.Strings(names)
+	procs := []interface{}{}
+	pruned := []string{}
+	for _, name := range names {
+		id := strings.TrimSuffix(filepath.Base(name), ".json")
+		e, err := readProcEntry(dir, id)
+		if err != nil || !e.alive() {
+			_ = os.Remove(name)
+			pruned = append(pruned, id)
+			continue
+		}
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "proc", Data: e.ID, Extra: e.extra()})
+		procs = append(procs, e.extra())
+	}
+	ok := true
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(0), Final: boolPtr(true), Extra: map[string]interface{}{"procs": procs, "pruned": pruned}})
+	return true
+}
+
+// procLogs emits the last req.TailLines (default 100) lines of a background
+// process log as stdout events.
+func procLogs(req runRequest, stdout io.Writer) bool {
+	if !validProcID(req.Name) {
+		return procFail(stdout, "logs: name required", "invalid-args")
+	}
+	dir := procsDir(req.Cwd)
+	logPath := filepath.Join(dir, req.Name+".log")
+	if e, err := readProcEntry(dir, req.Name); err == nil && e.LogFile != "" {
+		logPath = e.LogFile
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		reason := ""
+		if errors.Is(err, fs.ErrNotExist) {
+			reason = "not-found"
+		}
+		return procFail(stdout, err.Error(), reason)
+	}
+	defer f.Close()
+	n := req.TailLines
+	if n <= 0 {
+		n = 100
+	}
+	tail := &tailBuffer{n: n}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 1_000_000)
+	for s.Scan() {
+		if line := strings.TrimRight(s.Text(), "\r\n"); line != "" {
+			tail.add(line)
+		}
+	}
+	for _, line := range tail.snapshot() {
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "stdout", Data: line})
+	}
+	ok := true
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(0), Final: boolPtr(true), Extra: map[string]interface{}{"id": req.Name, "logFile": logPath}})
+	return true
+}
+
+// stopProc terminates a background process tree via killProcessTree and
+// removes its registry entry.
+func stopProc(req runRequest, stdout io.Writer) bool {
+	if !validProcID(req.Name) {
+		return procFail(stdout, "stop: name required", "invalid-args")
+	}
+	dir := procsDir(req.Cwd)
+	e, err := readProcEntry(dir, req.Name)
+	if err != nil {
+		return procFail(stdout, fmt.Sprintf("stop: no process named %q", req.Name), "not-found")
+	}
+	// A pid reused by another program since the entry was written reads as
+	// not running, so its group is never signalled.
+	running := e.alive()
+	if running {
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: fmt.Sprintf("stopping %s (pid %d)", e.ID, e.Pid)})
+		if p, ferr := os.FindProcess(e.Pid); ferr == nil {
+			killProcessTree(&exec.Cmd{Process: p})
+		}
+	}
+	_ = os.Remove(filepath.Join(dir, e.ID+".json"))
+	extra := e.extra()
+	extra["wasRunning"] = running
+	ok := true
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(0), Final: boolPtr(true), Extra: extra})
+	return true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// progressInterval is the minimum time between two "progress" events.
+const progressInterval = 250 * time.Millisecond
+
+// progressMeter emits throttled "progress" events while the files of a
+// pre-scanned tree are archived or hashed. Bytes are counted by writing them
+// to the meter; a nil meter reports nothing.
+type progressMeter struct {
+	mu         sync.Mutex
+	stdout     io.Writer
+	phase      string
+	totalFiles int
+	totalBytes int64
+	files      int
+	bytes      int64
+	start      time.Time
+	last       time.Time
+}
+
+func newProgressMeter(stdout io.Writer, phase string, totalFiles int, totalBytes int64) *progressMeter {
+	now := time.Now()
+	return &progressMeter{stdout: stdout, phase: phase, totalFiles: totalFiles, totalBytes: totalBytes, start: now, last: now}
+}
+
+// scanProgress sizes a meter from the file entries of scan. Preserved
+// symlinks count as files without bytes.
+func scanProgress(stdout io.Writer, phase string, scan *archiveScan) *progressMeter {
+	files, bytes := 0, int64(0)
+	for _, e := range scan.entries {
+		if e.info.IsDir() {
+			continue
+		}
+		files++
+		if e.link == "" {
+			bytes += e.info.Size()
+		}
+	}
+	return newProgressMeter(stdout, phase, files, bytes)
+}
+
+func (p *progressMeter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	p.bytes += int64(len(b))
+	p.tick()
+	p.mu.Unlock()
+	return len(b), nil
+}
+
+// wrap returns w, also counting what is written to it when p is not nil.
+func (p *progressMeter) wrap(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return io.MultiWriter(w, p)
+}
+
+// fileDone counts one finished file.
+func (p *progressMeter) fileDone() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.files++
+	p.tick()
+	p.mu.Unlock()
+}
+
+// finish emits the closing event, so the last one seen reports the final
+// counts.
+func (p *progressMeter) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.emit(time.Now())
+	p.mu.Unlock()
+}
+
+// tick emits an event when progressInterval has passed since the last one.
+// The caller holds p.mu.
+func (p *progressMeter) tick() {
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.emit(now)
+	}
+}
+
+func (p *progressMeter) emit(now time.Time) {
+	p.last = now
+	elapsed := now.Sub(p.start)
+	percent := 100.0
+	switch {
+	case p.totalBytes > 0:
+		percent = float64(p.bytes) / float64(p.totalBytes) * 100
+	case p.totalFiles > 0:
+		percent = float64(p.files) / float64(p.totalFiles) * 100
+	}
+	// Files can grow while they are read.
+	percent = math.Min(math.Round(percent*10)/10, 100)
+	var rate int64
+	if elapsed > 0 {
+		rate = int64(float64(p.bytes) / elapsed.Seconds())
+	}
+	writeEvent(p.stdout, ndjsonEvent{Action: "go", Event: "progress", Data: p.phase, Extra: map[string]interface{}{
+		"files":       p.files,
+		"totalFiles":  p.totalFiles,
+		"bytes":       p.bytes,
+		"totalBytes":  p.totalBytes,
+		"percent":     percent,
+		"bytesPerSec": rate,
+		"elapsedMs":   elapsed.Milliseconds(),
+	}})
+}
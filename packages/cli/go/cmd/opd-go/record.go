@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// castHeader is the first line of an asciicast v2 recording.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	// Opd holds the run-stream options replay needs to derive the same json
+	// and match events from the recorded lines. Other players ignore it.
+	Opd *castOptions `json:"opd,omitempty"`
+}
+
+type castOptions struct {
+	ParseJSON      bool            `json:"parseJson,omitempty"`
+	Extract        []extractorSpec `json:"extract,omitempty"`
+	ExtractPresets []string        `json:"extractPresets,omitempty"`
+}
+
+// castRecorder writes child output as asciicast v2 "o" events. A "m" marker
+// "stream:stderr" or "stream:stdout" precedes each switch between streams so
+// replay can restore them; the exit status is stored as a final "m" marker
+// "exit:<code>[:reason]".
+type castRecorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	start  time.Time
+	path   string
+	stream string
+}
+
+func openCastRecorder(cwd, path string, req runRequest) (*castRecorder, error) {
+	if !filepath.IsAbs(path) && cwd != "" {
+		path = filepath.Join(cwd, path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &castRecorder{f: f, w: bufio.NewWriter(f), start: time.Now(), path: path, stream: "stdout"}
+	hdr := castHeader{Version: 2, Width: req.Cols, Height: req.Rows, Timestamp: r.start.Unix(), Command: req.Cmd,
+		Env: map[string]string{"SHELL": os.Getenv("SHELL"), "TERM": os.Getenv("TERM")}}
+	if req.ParseJSON || len(req.Extract) > 0 || len(req.ExtractPresets) > 0 {
+		hdr.Opd = &castOptions{ParseJSON: req.ParseJSON, Extract: req.Extract, ExtractPresets: req.ExtractPresets}
+	}
+	if hdr.Width <= 0 {
+		hdr.Width = 80
+	}
+	if hdr.Height <= 0 {
+		hdr.Height = 24
+	}
+	enc, _ := json.Marshal(hdr)
+	_, _ = r.w.Write(append(enc, '\n'))
+	return r, nil
+}
+
+func (r *castRecorder) event(code, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeEventLocked(code, data)
+}
+
+func (r *castRecorder) writeEventLocked(code, data string) {
+	t := time.Since(r.start).Seconds()
+	enc, _ := json.Marshal([]interface{}{float64(int64(t*1e6)) / 1e6, code, data})
+	_, _ = r.w.Write(append(enc, '\n'))
+}
+
+// writeLine is an output hook for runStreamContext.
+func (r *castRecorder) writeLine(kind, line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if kind != r.stream {
+		r.stream = kind
+		r.writeEventLocked("m", "stream:"+kind)
+	}
+	r.writeEventLocked("o", line+"\r\n")
+}
+
+// finish records the exit marker and closes the file.
+func (r *castRecorder) finish(exitCode int, reason string) error {
+	marker := fmt.Sprintf("exit:%d", exitCode)
+	if reason != "" {
+		marker += ":" + reason
+	}
+	r.event("m", marker)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		_ = r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// replayCast reads an asciicast v2 recording and re-emits it as the NDJSON
+// stream run-stream produced, at the recorded pace or instantly.
+func replayCast(req runRequest, stdout io.Writer) bool {
+	if req.Src == "" {
+		ok := false
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: "replay: src required"})
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+		return false
+	}
+	fail := func(err error) bool {
+		ok := false
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error()})
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-recording"})
+		return false
+	}
+	f, err := os.Open(req.Src)
+	if err != nil {
+		return fail(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 4_000_000)
+	if !s.Scan() {
+		return fail(fmt.Errorf("replay: empty recording"))
+	}
+	var hdr castHeader
+	if err := json.Unmarshal(s.Bytes(), &hdr); err != nil || hdr.Version != 2 {
+		return fail(fmt.Errorf("replay: not an asciicast v2 recording"))
+	}
+	// Rebuild the line handling of the recorded run so json and match
+	// events come out as they did live.
+	lineReq := runRequest{}
+	var extractors *extractSet
+	if hdr.Opd != nil {
+		lineReq.ParseJSON = hdr.Opd.ParseJSON
+		if extractors, err = compileExtractors(hdr.Opd.Extract, hdr.Opd.ExtractPresets); err != nil {
+			return fail(fmt.Errorf("replay: %v", err))
+		}
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "replaying", Extra: map[string]interface{}{"command": hdr.Command, "timestamp": hdr.Timestamp}})
+	start := time.Now()
+	stream := "stdout"
+	exitCode, reason, recorded := 0, "", false
+	var last float64
+	for s.Scan() {
+		var ev []interface{}
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil || len(ev) < 3 {
+			return fail(fmt.Errorf("replay: malformed event line"))
+		}
+		t, _ := ev[0].(float64)
+		code, _ := ev[1].(string)
+		data, _ := ev[2].(string)
+		last = t
+		if !req.Instant {
+			if d := time.Duration(t*float64(time.Second)) - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		switch code {
+		case "o", "e":
+			kind := stream
+			if code == "e" {
+				// Recordings made before stream markers used "e" for stderr.
+				kind = "stderr"
+			}
+			for _, line := range strings.Split(data, "\n") {
+				line = strings.TrimRight(line, "\r")
+				if line != "" {
+					writeEvent(stdout, lineEvent(lineReq, kind, line))
+					if extractors != nil {
+						extractors.scan(kind, line, stdout)
+					}
+				}
+			}
+		case "m":
+			if rest, ok := strings.CutPrefix(data, "stream:"); ok && (rest == "stdout" || rest == "stderr") {
+				stream = rest
+			} else if rest, ok := strings.CutPrefix(data, "exit:"); ok {
+				codeStr, why, _ := strings.Cut(rest, ":")
+				if n, err := strconv.Atoi(codeStr); err == nil {
+					exitCode, reason, recorded = n, why, true
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fail(err)
+	}
+	ok := exitCode == 0
+	extra := map[string]interface{}{"replayed": req.Src, "durationMs": int64(last * 1000), "exitRecorded": recorded}
+	if extractors != nil {
+		extra["matches"] = extractors.values()
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: &exitCode, Final: boolPtr(true), Reason: reason, Extra: extra})
+	return true
+}
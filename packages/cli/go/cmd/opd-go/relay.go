@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// eventRelay is an io.Writer handed to a nested action in place of stdout.
+// It re-parses the NDJSON events the action writes, remembers its final done
+// event, and forwards each event to out after an optional rewrite hook.
+type eventRelay struct {
+	mu   sync.Mutex
+	out  io.Writer
+	buf  []byte
+	done *ndjsonEvent
+	// hook may rewrite an event before it is forwarded; returning false drops it.
+	hook func(ev *ndjsonEvent) bool
+}
+
+func (r *eventRelay) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, p...)
+	for {
+		i := bytes.IndexByte(r.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := append([]byte(nil), r.buf[:i]...)
+		r.buf = r.buf[i+1:]
+		var ev ndjsonEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			continue
+		}
+		if ev.Event == "done" {
+			d := ev
+			r.done = &d
+		}
+		if r.hook != nil && !r.hook(&ev) {
+			continue
+		}
+		writeEvent(r.out, ev)
+	}
+	return len(p), nil
+}
+
+// result returns the ok flag, exit code, reason and extra fields of the
+// captured done event. A missing done event counts as a failure.
+func (r *eventRelay) result() (bool, int, string, map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done == nil {
+		return false, 1, "no-result", nil
+	}
+	ok := r.done.OK != nil && *r.done.OK
+	code := 0
+	if r.done.Exit != nil {
+		code = *r.done.Exit
+	} else if !ok {
+		code = 1
+	}
+	return ok, code, r.done.Reason, r.done.Extra
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"time"
+)
+
+// retryPolicy is the run-stream retry configuration sent by the client.
+// Without onExitCodes or onOutput any failure is retried; with either set
+// only matching failures are. Cancelled runs are never retried.
+type retryPolicy struct {
+	MaxAttempts  int      `json:"maxAttempts,omitempty"`
+	BackoffMs    int      `json:"backoffMs,omitempty"`
+	MaxBackoffMs int      `json:"maxBackoffMs,omitempty"`
+	Jitter       *float64 `json:"jitter,omitempty"`
+	OnExitCodes  []int    `json:"onExitCodes,omitempty"`
+	OnOutput     []string `json:"onOutput,omitempty"`
+}
+
+// compiledRetry is a validated retryPolicy with defaults applied.
+type compiledRetry struct {
+	maxAttempts int
+	base        time.Duration
+	max         time.Duration
+	jitter      float64
+	onExitCodes []int
+	onOutput    []*regexp.Regexp
+}
+
+func compileRetryPolicy(p *retryPolicy) (compiledRetry, error) {
+	c := compiledRetry{maxAttempts: 1, base: time.Second, max: 30 * time.Second, jitter: 0.2}
+	if p == nil {
+		return c, nil
+	}
+	if p.MaxAttempts > 1 {
+		c.maxAttempts = p.MaxAttempts
+	}
+	if p.BackoffMs > 0 {
+		c.base = time.Duration(p.BackoffMs) * time.Millisecond
+	}
+	if p.MaxBackoffMs > 0 {
+		c.max = time.Duration(p.MaxBackoffMs) * time.Millisecond
+	}
+	if c.max < c.base {
+		c.max = c.base
+	}
+	if p.Jitter != nil {
+		c.jitter = min(max(*p.Jitter, 0), 1)
+	}
+	c.onExitCodes = p.OnExitCodes
+	for _, pat := range p.OnOutput {
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return c, fmt.Errorf("retry: invalid onOutput pattern %q: %v", pat, err)
+		}
+		c.onOutput = append(c.onOutput, re)
+	}
+	return c, nil
+}
+
+func (c compiledRetry) matchesOutput(line string) bool {
+	for _, re := range c.onOutput {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldRetry reports whether a failed attempt qualifies for another try.
+// outputMatched is true when any line of the attempt matched onOutput.
+func (c compiledRetry) shouldRetry(res attemptResult, outputMatched bool) bool {
+	if res.reason == "cancelled" || res.reason == "E_UNSUPPORTED" {
+		return false
+	}
+	if len(c.onExitCodes) == 0 && len(c.onOutput) == 0 {
+		return true
+	}
+	for _, code := range c.onExitCodes {
+		if code == res.exitCode {
+			return true
+		}
+	}
+	return outputMatched
+}
+
+// backoff returns the delay after the given failed attempt: exponential from
+// the base delay, capped at max, then spread by ±jitter.
+func (c compiledRetry) backoff(attempt int) time.Duration {
+	d := c.base
+	for i := 1; i < attempt && d < c.max; i++ {
+		d *= 2
+	}
+	d = min(d, c.max)
+	if c.jitter > 0 {
+		d = time.Duration(float64(d) * (1 + c.jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sandboxSpec is the run-stream sandbox option. The child runs with a
+// read-only view of the filesystem except for Writable, a private /tmp and,
+// unless Network is set, only a loopback interface. Hide masks files or
+// directories (default: common credential files) with empty placeholders.
+type sandboxSpec struct {
+	Network  bool      `json:"network,omitempty"`
+	Writable []string  `json:"writable,omitempty"`
+	Hide     *[]string `json:"hide,omitempty"`
+}
+
+// defaultSandboxHide lists credential files masked when hide is not given.
+var defaultSandboxHide = []string{"~/.npmrc", "~/.yarnrc", "~/.yarnrc.yml", "~/.netrc", "~/.docker/config.json", "~/.aws", "~/.config/gcloud"}
+
+// sandboxPaths resolves writable and hidden paths to absolute ones: "~/" is
+// the user's home, other relative paths are taken from cwd. Hidden paths that
+// do not exist are dropped.
+func sandboxPaths(spec *sandboxSpec, cwd string) (writable, hide []string, err error) {
+	if cwd == "" {
+		cwd = "."
+	}
+	home, _ := os.UserHomeDir()
+	resolve := func(p string) (string, error) {
+		if home != "" && (p == "~" || strings.HasPrefix(p, "~/")) {
+			p = filepath.Join(home, p[1:])
+		} else if !filepath.IsAbs(p) {
+			p = filepath.Join(cwd, p)
+		}
+		return filepath.Abs(p)
+	}
+	for _, p := range spec.Writable {
+		abs, err := resolve(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := os.MkdirAll(abs, 0o755); err != nil {
+			return nil, nil, err
+		}
+		if real, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = real
+		}
+		writable = append(writable, abs)
+	}
+	hidden := defaultSandboxHide
+	if spec.Hide != nil {
+		hidden = *spec.Hide
+	}
+	for _, p := range hidden {
+		abs, err := resolve(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := os.Lstat(abs); err == nil {
+			hide = append(hide, abs)
+		}
+	}
+	return writable, hide, nil
+}
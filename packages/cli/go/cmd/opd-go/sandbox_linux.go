@@ -0,0 +1,336 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// sandboxInitArg makes opd-go act as the namespace init for a sandboxed
+// command instead of reading a request from stdin.
+const (
+	sandboxInitArg = "__sandbox-init"
+	sandboxInitEnv = "OPD_SANDBOX_INIT"
+)
+
+// sandboxConfig is handed from the parent to the namespace init.
+type sandboxConfig struct {
+	Cmd      string   `json:"cmd"`
+	Writable []string `json:"writable,omitempty"`
+	Hide     []string `json:"hide,omitempty"`
+	Network  bool     `json:"network,omitempty"`
+}
+
+// Capabilities the init needs inside its user namespace; all are dropped
+// before the command is executed.
+const (
+	capSetpcap        = 8
+	capNetAdmin       = 12
+	capSysAdmin       = 21
+	prSetNoNewPrivs   = 38
+	prSetSecurebits   = 28
+	prCapAmbient      = 47
+	prCapAmbientClear = 4
+	// SECBIT_NOROOT and SECBIT_NO_CAP_AMBIENT_RAISE with their locks, so a
+	// uid 0 inside the namespace gains no capabilities on exec.
+	sandboxSecurebits = 0x1 | 0x2 | 0x40 | 0x80
+)
+
+// sandboxCommand rewrites cmd to re-exec opd-go as the init of fresh user,
+// mount and (unless network is allowed) network namespaces, which then runs
+// req.Cmd. The returned function must be called with cmd.Start's error; it
+// reports whether the init managed to set up the sandbox.
+func sandboxCommand(cmd *exec.Cmd, req runRequest) (func(error) error, error) {
+	if err := userNamespacesAvailable(); err != nil {
+		return nil, err
+	}
+	writable, hide, err := sandboxPaths(req.Sandbox, req.Cwd)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := json.Marshal(sandboxConfig{Cmd: req.Cmd, Writable: writable, Hide: hide, Network: req.Sandbox.Network})
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{"opd-go", sandboxInitArg}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env, sandboxInitEnv+"="+string(cfg))
+	cmd.ExtraFiles = []*os.File{w}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+	attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	if !req.Sandbox.Network {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+	attr.AmbientCaps = []uintptr{capSetpcap, capNetAdmin, capSysAdmin}
+	return func(startErr error) error {
+		_ = w.Close()
+		defer r.Close()
+		if startErr != nil {
+			return fmt.Errorf("sandbox: %v", startErr)
+		}
+		// The pipe is close-on-exec in the init: EOF without a message means
+		// the command was executed.
+		msg, _ := io.ReadAll(r)
+		if len(msg) > 0 {
+			return errors.New(string(msg))
+		}
+		return nil
+	}, nil
+}
+
+// userNamespacesAvailable checks the sysctls distributions use to turn off
+// unprivileged user namespaces.
+func userNamespacesAvailable() error {
+	if b, err := os.ReadFile("/proc/sys/user/max_user_namespaces"); err == nil && strings.TrimSpace(string(b)) == "0" {
+		return errors.New("sandbox: user namespaces are disabled (user.max_user_namespaces=0)")
+	}
+	if os.Getuid() != 0 {
+		if b, err := os.ReadFile("/proc/sys/kernel/unprivileged_userns_clone"); err == nil && strings.TrimSpace(string(b)) == "0" {
+			return errors.New("sandbox: unprivileged user namespaces are disabled (kernel.unprivileged_userns_clone=0)")
+		}
+	}
+	return nil
+}
+
+// sandboxInitIfRequested runs the namespace init when opd-go was re-executed
+// by sandboxCommand. It never returns in that case.
+func sandboxInitIfRequested() {
+	if len(os.Args) < 2 || os.Args[1] != sandboxInitArg {
+		return
+	}
+	status := os.NewFile(3, "sandbox-status")
+	fail := func(err error) {
+		fmt.Fprintf(status, "sandbox: %v", err)
+		os.Exit(125)
+	}
+	var cfg sandboxConfig
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxInitEnv)), &cfg); err != nil {
+		fail(fmt.Errorf("invalid init config: %v", err))
+	}
+	// Capabilities are per thread: drop them on the thread that execs.
+	runtime.LockOSThread()
+	if err := setupSandbox(cfg); err != nil {
+		fail(err)
+	}
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, sandboxInitEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	for _, op := range [][2]uintptr{{prCapAmbient, prCapAmbientClear}, {prSetSecurebits, sandboxSecurebits}, {prSetNoNewPrivs, 1}} {
+		if _, _, e := syscall.RawSyscall6(syscall.SYS_PRCTL, op[0], op[1], 0, 0, 0, 0); e != 0 {
+			fail(fmt.Errorf("drop capabilities: %v", e))
+		}
+	}
+	syscall.CloseOnExec(3)
+	fail(syscall.Exec("/bin/sh", []string{"/bin/sh", "-c", cfg.Cmd}, env))
+}
+
+// setupSandbox builds the filesystem view inside the new mount namespace.
+func setupSandbox(cfg sandboxConfig) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %v", err)
+	}
+	// Give every writable path its own mount so the read-only pass below can
+	// skip it, and keep a handle to re-attach those hidden by the new /tmp.
+	handles := map[string]*os.File{}
+	for _, p := range cfg.Writable {
+		if err := syscall.Mount(p, p, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %v", p, err)
+		}
+		if within("/tmp", p) {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			handles[p] = f
+		}
+	}
+	for _, p := range cfg.Hide {
+		if err := hidePath(p); err != nil {
+			return fmt.Errorf("hide %s: %v", p, err)
+		}
+	}
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+	for _, mp := range mounts {
+		if underAny(cfg.Writable, mp) {
+			continue
+		}
+		if err := remountReadOnly(mp); err != nil {
+			return fmt.Errorf("remount %s read-only: %v", mp, err)
+		}
+	}
+	for _, dir := range []string{"/tmp", "/dev/shm"} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mount private %s: %v", dir, err)
+		}
+	}
+	for p, f := range handles {
+		if err := os.MkdirAll(p, 0o755); err != nil {
+			return err
+		}
+		src := "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
+		if err := syscall.Mount(src, p, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %v", p, err)
+		}
+	}
+	if !cfg.Network {
+		if err := bringUpLoopback(); err != nil {
+			return fmt.Errorf("loopback: %v", err)
+		}
+	}
+	return nil
+}
+
+func underAny(roots []string, p string) bool {
+	for _, r := range roots {
+		if within(r, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// hidePath masks a directory with an empty read-only tmpfs and a file with
+// /dev/null.
+func hidePath(p string) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil
+	}
+	if info.IsDir() {
+		return syscall.Mount("tmpfs", p, "tmpfs", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755")
+	}
+	return syscall.Mount("/dev/null", p, "", syscall.MS_BIND, "")
+}
+
+// mountPoints lists the mount points visible in this namespace, parents
+// before children.
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		out = append(out, unescapeMountPath(fields[4]))
+	}
+	return out, s.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (\040 and friends) mountinfo
+// uses for whitespace and backslashes.
+func unescapeMountPath(p string) string {
+	if !strings.Contains(p, `\`) {
+		return p
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+3 < len(p) {
+			if n, err := strconv.ParseUint(p[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+// remountReadOnly makes the mount at mp read-only, keeping the nosuid,
+// nodev, noexec and atime flags the kernel refuses to clear in a user
+// namespace. Only mount points that have vanished are skipped; any other
+// failure leaves a writable mount behind and is returned, unless the mount
+// turns out to be read-only already.
+func remountReadOnly(mp string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mp, &st); err != nil {
+		if errors.Is(err, syscall.ENOENT) {
+			return nil
+		}
+		return err
+	}
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for _, f := range []struct{ st, ms uintptr }{
+		{0x2, syscall.MS_NOSUID},
+		{0x4, syscall.MS_NODEV},
+		{0x8, syscall.MS_NOEXEC},
+		{0x400, syscall.MS_NOATIME},
+		{0x800, syscall.MS_NODIRATIME},
+		{0x1000, syscall.MS_RELATIME},
+	} {
+		if uintptr(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	err := syscall.Mount("", mp, "", flags, "")
+	if err == nil || errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	const stRdonly = 0x1
+	if serr := syscall.Statfs(mp, &st); serr == nil && uintptr(st.Flags)&stRdonly != 0 {
+		return nil
+	}
+	return err
+}
+
+// bringUpLoopback sets IFF_UP on lo in the new network namespace.
+func bringUpLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	// struct ifreq: 16-byte name followed by the flags union.
+	var ifr [40]byte
+	copy(ifr[:], "lo")
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); e != 0 {
+		return e
+	}
+	*(*uint16)(unsafe.Pointer(&ifr[16])) |= syscall.IFF_UP
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// sandboxCommand is unavailable outside Linux; callers report E_UNSUPPORTED.
+func sandboxCommand(cmd *exec.Cmd, req runRequest) (func(error) error, error) {
+	return nil, errors.New("sandbox requires Linux user namespaces")
+}
+
+// sandboxInitIfRequested is a no-op outside Linux.
+func sandboxInitIfRequested() {}
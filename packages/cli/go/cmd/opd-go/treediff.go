@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+)
+
+// treeFile is one file of a tree-diff side: its content digest and size.
+// Symlinks are compared by their target.
+type treeFile struct {
+	sum  string
+	size int64
+}
+
+// treeSnapshot reads a directory or a zip/tar(.gz) archive into a map keyed
+// by slash path. prefix is stripped from archive entry names, so an archive
+// built with a prefix compares against the bare directory.
+func treeSnapshot(src, prefix string) (map[string]treeFile, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return dirSnapshot(src)
+	}
+	format, err := archiveFormat(src)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]treeFile{}
+	add := func(name string, r io.Reader) error {
+		name = strings.TrimPrefix(name, "./")
+		if prefix != "" {
+			name = strings.TrimPrefix(name, strings.Trim(prefix, "/")+"/")
+		}
+		if name == "" {
+			return nil
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, r)
+		if err != nil {
+			return err
+		}
+		files[name] = treeFile{sum: hex.EncodeToString(h.Sum(nil)), size: n}
+		return nil
+	}
+	if format == "zip" {
+		zr, err := zip.OpenReader(src)
+		if err != nil {
+			return nil, &archiveError{reason: "invalid-archive", err: err}
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			mode := f.Mode()
+			if mode.IsDir() || strings.HasSuffix(f.Name, "/") || (!mode.IsRegular() && mode&fs.ModeSymlink == 0) {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, &archiveError{reason: "invalid-archive", err: err}
+			}
+			err = add(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return nil, &archiveError{reason: "invalid-archive", err: fmt.Errorf("%s: %v", f.Name, err)}
+			}
+		}
+		return files, nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if format == "tar.gz" {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, &archiveError{reason: "invalid-archive", err: err}
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, &archiveError{reason: "invalid-archive", err: err}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			err = add(hdr.Name, tr)
+		case tar.TypeSymlink:
+			err = add(hdr.Name, strings.NewReader(hdr.Linkname))
+		}
+		if err != nil {
+			return nil, &archiveError{reason: "invalid-archive", err: fmt.Errorf("%s: %v", hdr.Name, err)}
+		}
+	}
+}
+
+// dirSnapshot hashes the files zip-dir would archive from dir: .opdignore
+// applies and symlinks are followed.
+func dirSnapshot(dir string) (map[string]treeFile, error) {
+	req := runRequest{Src: dir}
+	filter, err := loadArchiveFilter(req)
+	if err != nil {
+		return nil, &archiveError{reason: "invalid-args", err: err}
+	}
+	scan, err := collectEntries(req, filter)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]treeFile{}
+	for _, e := range scan.entries {
+		if e.info.IsDir() {
+			continue
+		}
+		sum, size, err := hashFile(e.path)
+		if err != nil {
+			return nil, err
+		}
+		files[e.name] = treeFile{sum: sum, size: size}
+	}
+	return files, nil
+}
+
+// treeDiff compares req.Base (the previous build) with req.Src, each a
+// directory or an archive, and emits one "diff" event per added, removed,
+// modified or renamed file in path order, then a summary. A removed and an
+// added file with the same content are reported as one rename.
+func treeDiff(req runRequest, stdout io.Writer) bool {
+	if req.Base == "" || req.Src == "" {
+		return archiveFail(stdout, "tree-diff: base and src required", "invalid-args")
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "hashing"})
+	before, err := treeSnapshot(req.Base, req.Prefix)
+	if err == nil {
+		var after map[string]treeFile
+		if after, err = treeSnapshot(req.Src, req.Prefix); err == nil {
+			return writeTreeDiff(before, after, stdout)
+		}
+	}
+	reason := ""
+	var ae *archiveError
+	if errors.As(err, &ae) {
+		reason = ae.reason
+	}
+	return archiveFail(stdout, err.Error(), reason)
+}
+
+func writeTreeDiff(before, after map[string]treeFile, stdout io.Writer) bool {
+	var added, removed []string
+	type change struct {
+		path  string
+		extra map[string]interface{}
+	}
+	var changes []change
+	var nAdded, nRemoved, nModified, nRenamed, nUnchanged int
+	var beforeBytes, afterBytes, addedBytes, removedBytes int64
+	for p, b := range before {
+		beforeBytes += b.size
+		a, ok := after[p]
+		switch {
+		case !ok:
+			removed = append(removed, p)
+		case a.sum != b.sum:
+			nModified++
+			changes = append(changes, change{p, map[string]interface{}{"change": "modified", "path": p, "oldSize": b.size, "size": a.size, "delta": a.size - b.size}})
+		default:
+			nUnchanged++
+		}
+	}
+	for p, a := range after {
+		afterBytes += a.size
+		if _, ok := before[p]; !ok {
+			added = append(added, p)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+	// Pair removed and added files by content; the first unused removed
+	// path (in path order) becomes the rename source.
+	pool := map[string][]string{}
+	for _, p := range removed {
+		pool[before[p].sum] = append(pool[before[p].sum], p)
+	}
+	renamedFrom := map[string]bool{}
+	for _, p := range added {
+		a := after[p]
+		if srcs := pool[a.sum]; len(srcs) > 0 {
+			pool[a.sum] = srcs[1:]
+			renamedFrom[srcs[0]] = true
+			nRenamed++
+			changes = append(changes, change{p, map[string]interface{}{"change": "renamed", "path": p, "from": srcs[0], "size": a.size, "delta": 0}})
+			continue
+		}
+		nAdded++
+		addedBytes += a.size
+		changes = append(changes, change{p, map[string]interface{}{"change": "added", "path": p, "size": a.size, "delta": a.size}})
+	}
+	for _, p := range removed {
+		if renamedFrom[p] {
+			continue
+		}
+		b := before[p]
+		nRemoved++
+		removedBytes += b.size
+		changes = append(changes, change{p, map[string]interface{}{"change": "removed", "path": p, "oldSize": b.size, "delta": -b.size}})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	for _, c := range changes {
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "diff", Data: c.path, Extra: c.extra})
+	}
+	extra := map[string]interface{}{
+		"added":        nAdded,
+		"removed":      nRemoved,
+		"modified":     nModified,
+		"renamed":      nRenamed,
+		"unchanged":    nUnchanged,
+		"changed":      len(changes) > 0,
+		"baseFiles":    len(before),
+		"baseBytes":    beforeBytes,
+		"files":        len(after),
+		"bytes":        afterBytes,
+		"bytesAdded":   addedBytes,
+		"bytesRemoved": removedBytes,
+		"sizeDelta":    afterBytes - beforeBytes,
+	}
+	ok := true
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(0), Final: boolPtr(true), Extra: extra})
+	return true
+}
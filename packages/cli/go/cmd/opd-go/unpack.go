@@ -0,0 +1,466 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default limits for unzip and untar, guarding against archive bombs.
+const (
+	defaultUnpackMaxBytes   = 4 << 30
+	defaultUnpackMaxEntries = 100_000
+)
+
+// unpacker writes archive entries below root, refusing anything that would
+// land outside it.
+type unpacker struct {
+	root       string // extraction directory with symlinks resolved
+	maxBytes   int64
+	maxEntries int
+	dirModes   map[string]fs.FileMode
+
+	entries, files, dirs, symlinks, hardlinks, skipped int
+	bytes                                              int64
+}
+
+func unpackErr(reason, format string, args ...interface{}) error {
+	return &archiveError{reason: reason, err: fmt.Errorf(format, args...)}
+}
+
+// entryPath validates an archive entry name and returns it as a local path
+// ("" for the root itself). Absolute names, drive letters and ".." segments
+// are rejected.
+func entryPath(name string) (string, error) {
+	n := strings.ReplaceAll(name, `\`, "/")
+	if n == "" || strings.ContainsRune(n, 0) {
+		return "", unpackErr("unsafe-path", "invalid entry name %q", name)
+	}
+	if strings.HasPrefix(n, "/") || (len(n) >= 2 && n[1] == ':') {
+		return "", unpackErr("unsafe-path", "entry %q has an absolute path", name)
+	}
+	for _, seg := range strings.Split(n, "/") {
+		if seg == ".." {
+			return "", unpackErr("unsafe-path", "entry %q escapes the destination", name)
+		}
+	}
+	clean := path.Clean(n)
+	if clean == "." {
+		return "", nil
+	}
+	local := filepath.FromSlash(clean)
+	if !filepath.IsLocal(local) {
+		return "", unpackErr("unsafe-path", "entry %q is not a valid local path", name)
+	}
+	return local, nil
+}
+
+// count applies the entry limit.
+func (u *unpacker) count() error {
+	u.entries++
+	if u.entries > u.maxEntries {
+		return unpackErr("limit-exceeded", "archive has more than %d entries (maxEntries)", u.maxEntries)
+	}
+	return nil
+}
+
+// ensureDir creates the directory at local below root one segment at a time
+// and returns its real path. Existing symlinks are only followed when they
+// resolve inside root.
+func (u *unpacker) ensureDir(local string) (string, error) {
+	cur := u.root
+	if local == "" || local == "." {
+		return cur, nil
+	}
+	for _, seg := range strings.Split(filepath.ToSlash(local), "/") {
+		cur = filepath.Join(cur, seg)
+		fi, err := os.Lstat(cur)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if err := os.Mkdir(cur, 0o755); err != nil {
+				return "", err
+			}
+			u.dirs++
+		case err != nil:
+			return "", err
+		case fi.Mode()&fs.ModeSymlink != 0:
+			real, err := filepath.EvalSymlinks(cur)
+			if err != nil || !within(u.root, real) {
+				return "", unpackErr("unsafe-path", "%s is a symlink leading outside the destination", local)
+			}
+			if st, err := os.Stat(real); err != nil || !st.IsDir() {
+				return "", unpackErr("unsafe-path", "%s is not a directory", local)
+			}
+			cur = real
+		case !fi.IsDir():
+			return "", unpackErr("unsafe-path", "%s is not a directory", local)
+		}
+	}
+	return cur, nil
+}
+
+// prepare returns the real path an entry at local is written to, removing a
+// previous non-directory there so writes never follow an existing link.
+func (u *unpacker) prepare(local string) (string, error) {
+	dir, err := u.ensureDir(filepath.Dir(local))
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, filepath.Base(local))
+	if fi, err := os.Lstat(target); err == nil {
+		if fi.IsDir() {
+			return "", unpackErr("unsafe-path", "entry %s would replace a directory", filepath.ToSlash(local))
+		}
+		if err := os.Remove(target); err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+func (u *unpacker) dir(local string, mode fs.FileMode) error {
+	real, err := u.ensureDir(local)
+	if err != nil {
+		return err
+	}
+	if perm := mode.Perm(); perm != 0 {
+		// Applied after all entries so read-only directories can be filled.
+		u.dirModes[real] = perm
+	}
+	return nil
+}
+
+func (u *unpacker) file(local string, mode fs.FileMode, mtime time.Time, r io.Reader) error {
+	target, err := u.prepare(local)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, u.maxBytes-u.bytes+1))
+	u.bytes += n
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if u.bytes > u.maxBytes {
+		return unpackErr("limit-exceeded", "archive expands to more than %d bytes (maxBytes)", u.maxBytes)
+	}
+	perm := mode.Perm()
+	if perm == 0 {
+		perm = 0o644
+	}
+	if err := os.Chmod(target, perm); err != nil {
+		return err
+	}
+	if !mtime.IsZero() {
+		_ = os.Chtimes(target, mtime, mtime)
+	}
+	u.files++
+	return nil
+}
+
+// symlink creates a link whose target, resolved from the link's real
+// directory, stays inside root. The kernel follows links before applying
+// "..", so a ".." after a named segment could climb out through a link to
+// "." (d -> ., e -> d/d/../..) even when the lexical path stays inside; only
+// leading ".." segments are allowed.
+func (u *unpacker) symlink(local, target string) error {
+	t := strings.ReplaceAll(target, `\`, "/")
+	if t == "" || strings.ContainsRune(t, 0) || path.IsAbs(t) || (len(t) >= 2 && t[1] == ':') {
+		return unpackErr("unsafe-path", "symlink %s has unsafe target %q", filepath.ToSlash(local), target)
+	}
+	named := false
+	for _, seg := range strings.Split(t, "/") {
+		switch {
+		case seg == ".." && named:
+			return unpackErr("unsafe-path", "symlink %s has \"..\" after a path segment in target %q", filepath.ToSlash(local), target)
+		case seg != "" && seg != "." && seg != "..":
+			named = true
+		}
+	}
+	dest, err := u.prepare(local)
+	if err != nil {
+		return err
+	}
+	resolved := filepath.Join(filepath.Dir(dest), filepath.FromSlash(t))
+	if !within(u.root, resolved) {
+		return unpackErr("unsafe-path", "symlink %s -> %s points outside the destination", filepath.ToSlash(local), target)
+	}
+	// Check the deepest part of the target that already exists, so a link
+	// through an outside-pointing link left in dest is caught too.
+	for p := resolved; within(u.root, p); p = filepath.Dir(p) {
+		if real, err := filepath.EvalSymlinks(p); err == nil {
+			if !within(u.root, real) {
+				return unpackErr("unsafe-path", "symlink %s -> %s resolves outside the destination", filepath.ToSlash(local), target)
+			}
+			break
+		}
+	}
+	if err := os.Symlink(filepath.FromSlash(t), dest); err != nil {
+		return err
+	}
+	u.symlinks++
+	return nil
+}
+
+// hardlink links local to an already extracted regular file.
+func (u *unpacker) hardlink(local, linkname string) error {
+	src, err := entryPath(linkname)
+	if err != nil || src == "" {
+		return unpackErr("unsafe-path", "hard link %s has unsafe target %q", filepath.ToSlash(local), linkname)
+	}
+	srcDir, err := filepath.EvalSymlinks(filepath.Join(u.root, filepath.Dir(src)))
+	if err != nil || !within(u.root, srcDir) {
+		return unpackErr("unsafe-path", "hard link %s -> %s points outside the destination", filepath.ToSlash(local), linkname)
+	}
+	srcPath := filepath.Join(srcDir, filepath.Base(src))
+	if fi, err := os.Lstat(srcPath); err != nil || !fi.Mode().IsRegular() {
+		return unpackErr("unsafe-path", "hard link %s -> %s does not name an extracted file", filepath.ToSlash(local), linkname)
+	}
+	dest, err := u.prepare(local)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(srcPath, dest); err != nil {
+		return err
+	}
+	u.hardlinks++
+	return nil
+}
+
+// finish applies directory modes, deepest first.
+func (u *unpacker) finish() error {
+	dirs := make([]string, 0, len(u.dirModes))
+	for d := range u.dirModes {
+		dirs = append(dirs, d)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		if err := os.Chmod(d, u.dirModes[d]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpackTarget prepares the extraction directory. A missing dest is built in
+// a temp directory next to it and renamed into place by commit, so it only
+// appears once complete; an existing directory is extracted into directly.
+func unpackTarget(dest string) (root string, commit func(error) error, err error) {
+	fi, err := os.Stat(dest)
+	if err == nil {
+		if !fi.IsDir() {
+			return "", nil, fmt.Errorf("%s exists and is not a directory", dest)
+		}
+		return dest, func(err error) error { return err }, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", nil, err
+	}
+	parent := filepath.Dir(dest)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return "", nil, err
+	}
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return "", nil, err
+	}
+	stop := removeOnSignal(tmp)
+	return tmp, func(err error) error {
+		stop()
+		if err == nil {
+			if err = os.Chmod(tmp, 0o755); err == nil {
+				err = os.Rename(tmp, dest)
+			}
+		}
+		if err != nil {
+			_ = os.RemoveAll(tmp)
+		}
+		return err
+	}, nil
+}
+
+// unpackArchive runs extract against a fresh unpacker rooted at req.Dest and
+// writes the final done event.
+func unpackArchive(req runRequest, stdout io.Writer, extract func(*unpacker) error) bool {
+	if req.Src == "" || req.Dest == "" {
+		return archiveFail(stdout, req.Action+": src and dest required", "invalid-args")
+	}
+	u := &unpacker{maxBytes: req.MaxBytes, maxEntries: req.MaxEntries, dirModes: map[string]fs.FileMode{}}
+	if u.maxBytes <= 0 {
+		u.maxBytes = defaultUnpackMaxBytes
+	}
+	if u.maxEntries <= 0 {
+		u.maxEntries = defaultUnpackMaxEntries
+	}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "extracting"})
+	root, commit, err := unpackTarget(req.Dest)
+	if err != nil {
+		return archiveFail(stdout, err.Error(), "")
+	}
+	if u.root, err = filepath.Abs(root); err == nil {
+		u.root, err = filepath.EvalSymlinks(u.root)
+	}
+	if err == nil {
+		err = extract(u)
+	}
+	if err == nil {
+		err = u.finish()
+	}
+	err = commit(err)
+	ok := err == nil
+	reason := ""
+	if !ok {
+		var ae *archiveError
+		if errors.As(err, &ae) {
+			reason = ae.reason
+		}
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: err.Error(), Reason: reason})
+	}
+	extra := map[string]interface{}{"dest": req.Dest, "entries": u.entries, "files": u.files, "dirs": u.dirs, "symlinks": u.symlinks, "hardlinks": u.hardlinks, "skipped": u.skipped, "bytes": u.bytes}
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(map[bool]int{true: 0, false: 1}[ok]), Final: boolPtr(true), Reason: reason, Extra: extra})
+	return ok
+}
+
+// unzipArchive extracts the zip at req.Src into req.Dest.
+func unzipArchive(req runRequest, stdout io.Writer) bool {
+	return unpackArchive(req, stdout, func(u *unpacker) error {
+		zr, err := zip.OpenReader(req.Src)
+		if err != nil {
+			return unpackErr("invalid-archive", "%s: %v", req.Src, err)
+		}
+		defer zr.Close()
+		if len(zr.File) > u.maxEntries {
+			return unpackErr("limit-exceeded", "archive has %d entries, more than %d (maxEntries)", len(zr.File), u.maxEntries)
+		}
+		var declared uint64
+		for _, f := range zr.File {
+			declared += f.UncompressedSize64
+		}
+		if declared > uint64(u.maxBytes) {
+			return unpackErr("limit-exceeded", "archive declares %d bytes, more than %d (maxBytes)", declared, u.maxBytes)
+		}
+		for _, f := range zr.File {
+			if err := u.count(); err != nil {
+				return err
+			}
+			local, err := entryPath(f.Name)
+			if err != nil {
+				return err
+			}
+			mode := f.Mode()
+			switch {
+			case local == "":
+			case mode.IsDir() || strings.HasSuffix(f.Name, "/"):
+				err = u.dir(local, mode)
+			case mode&fs.ModeSymlink != 0:
+				var target []byte
+				if target, err = readZipEntry(f, 4096); err == nil {
+					err = u.symlink(local, string(target))
+				}
+			case mode.IsRegular():
+				var rc io.ReadCloser
+				if rc, err = f.Open(); err == nil {
+					err = u.file(local, mode, f.Modified, rc)
+					rc.Close()
+				}
+				if errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrFormat) {
+					err = unpackErr("invalid-archive", "%s: %s: %v", req.Src, f.Name, err)
+				}
+			default:
+				u.skipped++
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func readZipEntry(f *zip.File, max int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, max))
+}
+
+// untarArchive extracts the tar at req.Src into req.Dest, decompressing it
+// first when it starts with the gzip magic bytes.
+func untarArchive(req runRequest, stdout io.Writer) bool {
+	return unpackArchive(req, stdout, func(u *unpacker) error {
+		f, err := os.Open(req.Src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		br := bufio.NewReader(f)
+		var r io.Reader = br
+		if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			gr, err := gzip.NewReader(br)
+			if err != nil {
+				return unpackErr("invalid-archive", "%s: %v", req.Src, err)
+			}
+			defer gr.Close()
+			r = gr
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return unpackErr("invalid-archive", "%s: %v", req.Src, err)
+			}
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				continue
+			}
+			if err := u.count(); err != nil {
+				return err
+			}
+			local, err := entryPath(hdr.Name)
+			if err != nil {
+				return err
+			}
+			mode := fs.FileMode(hdr.Mode).Perm()
+			switch {
+			case local == "":
+			case hdr.Typeflag == tar.TypeDir:
+				err = u.dir(local, mode)
+			case hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA:
+				err = u.file(local, mode, hdr.ModTime, tr)
+			case hdr.Typeflag == tar.TypeSymlink:
+				err = u.symlink(local, hdr.Linkname)
+			case hdr.Typeflag == tar.TypeLink:
+				err = u.hardlink(local, hdr.Linkname)
+			default:
+				u.skipped++
+			}
+			if err != nil {
+				if errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+					return unpackErr("invalid-archive", "%s: %v", req.Src, err)
+				}
+				return err
+			}
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWaitTimeout  = 60 * time.Second
+	defaultWaitInterval = time.Second
+	// waitProbeTimeout bounds a single probe so a hung server cannot eat
+	// the whole deadline.
+	waitProbeTimeout = 10 * time.Second
+)
+
+// waitUntil calls probe every interval until it succeeds or the deadline
+// passes, emitting a status event for each failed probe. It writes the final
+// done event with the time to ready or the last failure.
+func waitUntil(req runRequest, target string, stdout io.Writer, probe func(ctx context.Context) (map[string]interface{}, error)) bool {
+	timeout := defaultWaitTimeout
+	if req.TimeoutSec > 0 {
+		timeout = time.Duration(req.TimeoutSec) * time.Second
+	}
+	interval := defaultWaitInterval
+	if req.IntervalMs > 0 {
+		interval = time.Duration(req.IntervalMs) * time.Millisecond
+	}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "waiting for " + target})
+	lastErr := ""
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithDeadline(context.Background(), minTime(deadline, time.Now().Add(waitProbeTimeout)))
+		info, err := probe(ctx)
+		cancel()
+		elapsed := time.Since(start).Milliseconds()
+		if err == nil {
+			extra := map[string]interface{}{"target": target, "attempts": attempt, "elapsedMs": elapsed}
+			for k, v := range info {
+				extra[k] = v
+			}
+			ok := true
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(0), Final: boolPtr(true), Extra: extra})
+			return true
+		}
+		lastErr = err.Error()
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "status", Data: "not ready: " + lastErr, Extra: map[string]interface{}{"attempt": attempt, "elapsedMs": elapsed}})
+		if time.Now().Add(interval).After(deadline) {
+			ok := false
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: fmt.Sprintf("%s not ready after %s: %s", target, timeout, lastErr), Reason: "timeout"})
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(124), Final: boolPtr(true), Reason: "timeout",
+				Extra: map[string]interface{}{"target": target, "attempts": attempt, "elapsedMs": elapsed, "lastError": lastErr}})
+			return false
+		}
+		time.Sleep(interval)
+	}
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// waitHTTP polls req.URL until it answers with req.ExpectStatus (any 2xx by
+// default), a body matching req.BodyRegex and the req.ExpectHeaders values.
+func waitHTTP(req runRequest, stdout io.Writer) bool {
+	if req.URL == "" {
+		ok := false
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: "wait-http: url required"})
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+		return false
+	}
+	var bodyRe *regexp.Regexp
+	if req.BodyRegex != "" {
+		var err error
+		if bodyRe, err = regexp.Compile(req.BodyRegex); err != nil {
+			ok := false
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: fmt.Sprintf("wait-http: invalid bodyRegex: %v", err)})
+			writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+			return false
+		}
+	}
+	httpc := &http.Client{}
+	return waitUntil(req, req.URL, stdout, func(ctx context.Context) (map[string]interface{}, error) {
+		hreq, err := http.NewRequestWithContext(ctx, "GET", req.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range req.Headers {
+			hreq.Header.Set(k, v)
+		}
+		resp, err := httpc.Do(hreq)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if req.ExpectStatus > 0 && resp.StatusCode != req.ExpectStatus {
+			return nil, fmt.Errorf("status %d, want %d", resp.StatusCode, req.ExpectStatus)
+		}
+		if req.ExpectStatus == 0 && resp.StatusCode/100 != 2 {
+			return nil, fmt.Errorf("status %d", resp.StatusCode)
+		}
+		for k, want := range req.ExpectHeaders {
+			if got := resp.Header.Get(k); !strings.Contains(got, want) {
+				return nil, fmt.Errorf("header %s is %q, want %q", k, got, want)
+			}
+		}
+		if bodyRe != nil {
+			body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+			if err != nil {
+				return nil, err
+			}
+			if !bodyRe.Match(body) {
+				return nil, fmt.Errorf("body does not match %s", req.BodyRegex)
+			}
+		}
+		return map[string]interface{}{"status": resp.StatusCode}, nil
+	})
+}
+
+// waitPort polls until req.Host:req.Port accepts TCP connections.
+func waitPort(req runRequest, stdout io.Writer) bool {
+	if req.Port <= 0 {
+		ok := false
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "error", Error: "wait-port: port required"})
+		writeEvent(stdout, ndjsonEvent{Action: "go", Event: "done", OK: &ok, Exit: intPtr(1), Final: boolPtr(true), Reason: "invalid-args"})
+		return false
+	}
+	host := req.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(req.Port))
+	var d net.Dialer
+	return waitUntil(req, addr, stdout, func(ctx context.Context) (map[string]interface{}, error) {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		_ = conn.Close()
+		return nil, nil
+	})
+}
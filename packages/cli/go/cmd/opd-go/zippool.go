@@ -0,0 +1,350 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// zipDeflateLevel is the level archive/zip's own Deflate compressor uses, so
+// by default entries deflated by the pool match streamed ones.
+const zipDeflateLevel = 5
+
+// maxZipWorkers caps the pool whatever concurrency asks for: each worker can
+// hold a flate.Writer (about 1MB) and two spools of up to zipSpoolLimit, and
+// writing entries in order stops scaling well before that many cores.
+const maxZipWorkers = 32
+
+// zipSpoolLimit is how much data a worker keeps in memory for one entry
+// before moving it to a temp file next to the archive.
+const zipSpoolLimit = 4 << 20
+
+// zipJob is one file compressed by the worker pool ahead of the writer.
+type zipJob struct {
+	entry  archiveEntry
+	method uint16
+	data   *spool // content as written to the archive
+	crc    uint32
+	size   int64 // uncompressed
+	digest *fileDigest
+	err    error
+	done   chan struct{}
+}
+
+// zipPool compresses the files of an archive on up to workers goroutines while
+// the caller writes finished entries in order. At most twice as many files
+// as there are workers are in flight, which bounds memory to a few spool
+// limits per worker.
+type zipPool struct {
+	workers  int
+	spoolDir string
+	digest   bool
+	progress *progressMeter
+	policy   *compressionPolicy
+	jobs     []*zipJob // by entry index; nil for directories and links
+	window   chan struct{}
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// zipWorkers is the pool size for req.Concurrency: all CPUs when unset,
+// and never more than maxZipWorkers.
+func zipWorkers(req runRequest) int {
+	n := req.Concurrency
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	return min(n, maxZipWorkers)
+}
+
+// startZipPool queues every regular file of entries and starts up to workers
+// workers, no more than there are files. stop must be called once the
+// caller is done with the jobs.
+func startZipPool(entries []archiveEntry, workers int, spoolDir string, digest bool, progress *progressMeter, policy *compressionPolicy) *zipPool {
+	jobs := make([]*zipJob, len(entries))
+	files := 0
+	for i, e := range entries {
+		if !e.info.IsDir() && e.link == "" {
+			jobs[i] = &zipJob{entry: e, done: make(chan struct{})}
+			files++
+		}
+	}
+	workers = max(min(workers, files), 1)
+	p := &zipPool{
+		workers:  workers,
+		spoolDir: spoolDir,
+		digest:   digest,
+		progress: progress,
+		policy:   policy,
+		jobs:     jobs,
+		window:   make(chan struct{}, 2*workers),
+		quit:     make(chan struct{}),
+	}
+	queue := make(chan *zipJob)
+	go func() {
+		defer close(queue)
+		for _, j := range p.jobs {
+			if j == nil {
+				continue
+			}
+			select {
+			case p.window <- struct{}{}:
+			case <-p.quit:
+				return
+			}
+			select {
+			case queue <- j:
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			d := &deflater{level: policy.level}
+			for j := range queue {
+				p.compress(j, d)
+				close(j.done)
+			}
+		}()
+	}
+	return p
+}
+
+// wait blocks until the job for entry i is compressed and frees its slot.
+func (p *zipPool) wait(i int) *zipJob {
+	j := p.jobs[i]
+	<-j.done
+	<-p.window
+	return j
+}
+
+// stop ends the workers and drops any spooled data left over after an
+// error.
+func (p *zipPool) stop() {
+	close(p.quit)
+	p.wg.Wait()
+	for _, j := range p.jobs {
+		if j != nil && j.data != nil {
+			j.data.release()
+		}
+	}
+}
+
+// compress stores or deflates the file of j following the policy. With a
+// store threshold the file is also kept as-is while it is deflated, so it is
+// read only once whichever is written.
+func (p *zipPool) compress(j *zipJob, d *deflater) {
+	f, err := os.Open(j.entry.path)
+	if err != nil {
+		j.err = err
+		return
+	}
+	defer f.Close()
+	j.data = newSpool(p.spoolDir)
+	var raw *spool
+	var fw *flate.Writer
+	var w io.Writer = j.data
+	j.method = zip.Store
+	if !p.policy.stores(j.entry.name) {
+		j.method = zip.Deflate
+		fw = d.reset(j.data)
+		w = fw
+		if p.policy.threshold > 0 {
+			raw = newSpool(p.spoolDir)
+			w = io.MultiWriter(fw, raw)
+		}
+	}
+	crc := crc32.NewIEEE()
+	w = io.MultiWriter(w, crc)
+	if p.digest {
+		j.digest = newFileDigest()
+		w = io.MultiWriter(w, j.digest)
+	}
+	j.size, j.err = io.Copy(p.progress.wrap(w), f)
+	if j.method == zip.Deflate {
+		if cerr := fw.Close(); j.err == nil {
+			j.err = cerr
+		}
+	}
+	if j.err == nil {
+		j.err = j.data.err
+	}
+	j.crc = crc.Sum32()
+	if raw == nil {
+		return
+	}
+	if j.err == nil && raw.err == nil && p.policy.storesDeflated(j.size, j.data.size) {
+		raw, j.data = j.data, raw
+		j.method = zip.Store
+	}
+	raw.release()
+}
+
+// deflater is a worker's flate.Writer, created on first use so a worker that
+// only stores files never allocates one.
+type deflater struct {
+	level int
+	fw    *flate.Writer
+}
+
+// reset returns the writer, set to compress into w.
+func (d *deflater) reset(w io.Writer) *flate.Writer {
+	if d.fw == nil {
+		d.fw, _ = flate.NewWriter(w, d.level)
+	} else {
+		d.fw.Reset(w)
+	}
+	return d.fw
+}
+
+// writeRaw adds the compressed job under hdr.
+func (j *zipJob) writeRaw(zw *zip.Writer, hdr *zip.FileHeader) error {
+	hdr.Method = j.method
+	rawZipHeader(hdr, j.crc, j.size, j.data.size)
+	w, err := zw.CreateRaw(hdr)
+	if err != nil {
+		return err
+	}
+	err = j.data.writeTo(w)
+	j.data.release()
+	j.data = nil
+	return err
+}
+
+// spoolBuffers recycles the in-memory part of spools across entries.
+var spoolBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// spool holds entry data in memory up to zipSpoolLimit and in a temp file
+// beyond it.
+type spool struct {
+	dir  string
+	buf  *bytes.Buffer
+	file *os.File
+	size int64
+	err  error
+}
+
+func newSpool(dir string) *spool {
+	return &spool{dir: dir, buf: spoolBuffers.Get().(*bytes.Buffer)}
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.file == nil && s.buf.Len()+len(p) > zipSpoolLimit {
+		if s.file, s.err = createSpoolFile(s.dir); s.err != nil {
+			return 0, s.err
+		}
+		if _, s.err = s.buf.WriteTo(s.file); s.err != nil {
+			return 0, s.err
+		}
+	}
+	var n int
+	if s.file != nil {
+		n, s.err = s.file.Write(p)
+	} else {
+		n, _ = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, s.err
+}
+
+func (s *spool) writeTo(w io.Writer) error {
+	if s.file == nil {
+		_, err := s.buf.WriteTo(w)
+		return err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, s.file)
+	return err
+}
+
+func (s *spool) release() {
+	if s.buf != nil {
+		s.buf.Reset()
+		spoolBuffers.Put(s.buf)
+		s.buf = nil
+	}
+	if s.file != nil {
+		s.file.Close()
+		_ = os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
+
+// createSpoolFile creates a temp file in dir. Outside Windows it is unlinked
+// right away, so an interrupted archive leaves nothing behind.
+func createSpoolFile(dir string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, ".opd-zip-*.spool")
+	if err == nil && runtime.GOOS != "windows" {
+		_ = os.Remove(f.Name())
+	}
+	return f, err
+}
+
+// rawZipHeader completes hdr the way zip.Writer.CreateHeader would for a
+// streamed file (UTF-8 flag, versions, MS-DOS and extended timestamps, data
+// descriptor) and records the precomputed checksum and sizes, so CreateRaw
+// writes the same bytes.
+func rawZipHeader(hdr *zip.FileHeader, crc uint32, size, compressed int64) {
+	if valid, require := zipNameUTF8(hdr.Name); valid && require && !hdr.NonUTF8 {
+		hdr.Flags |= 0x800
+	}
+	hdr.CreatorVersion = hdr.CreatorVersion&0xff00 | 20
+	hdr.ReaderVersion = 20
+	if !hdr.Modified.IsZero() {
+		hdr.ModifiedDate, hdr.ModifiedTime = msDosTime(hdr.Modified)
+		var ext [9]byte
+		binary.LittleEndian.PutUint16(ext[0:], 0x5455) // extended timestamp
+		binary.LittleEndian.PutUint16(ext[2:], 5)
+		ext[4] = 1 // modification time only
+		binary.LittleEndian.PutUint32(ext[5:], uint32(hdr.Modified.Unix()))
+		hdr.Extra = append(hdr.Extra, ext[:]...)
+	}
+	hdr.Flags |= 0x8
+	hdr.CRC32 = crc
+	hdr.UncompressedSize64 = uint64(size)
+	hdr.CompressedSize64 = uint64(compressed)
+	if size > math.MaxUint32 || compressed > math.MaxUint32 {
+		hdr.ReaderVersion = 45 // zip64
+	}
+}
+
+// zipNameUTF8 reports whether name is valid UTF-8 and whether it needs the
+// UTF-8 flag, using archive/zip's rule: anything outside the ASCII range
+// readers agree on.
+func zipNameUTF8(name string) (valid, require bool) {
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		i += size
+		if r < 0x20 || r > 0x7d || r == 0x5c {
+			if r == utf8.RuneError && size == 1 {
+				return false, false
+			}
+			require = true
+		}
+	}
+	return true, require
+}
+
+// msDosTime converts t to the MS-DOS date and time fields of a zip header.
+func msDosTime(t time.Time) (date, tm uint16) {
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tm = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, tm
+}